@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/expense"
+	"github.com/likeawizard/document-ai-demo/store"
+	"github.com/likeawizard/document-ai-demo/web"
+)
+
+func main() {
+	configPath := flag.String("config", config.CONFIG_PATH, "path to the config file")
+	addr := flag.String("addr", ":8080", "address the REST API listens on")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for in-flight receipts on shutdown")
+	rotateKeys := flag.Bool("rotate-keys", false, "re-encrypt the stored files with the current encryption key and exit")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("failed to load config '%s': %s", *configPath, err)
+	}
+
+	db, err := database.NewDataBase(cfg.Db)
+	if err != nil {
+		log.Fatalf("failed to initialize database: %s", err)
+	}
+
+	fs, err := store.NewFileStore(cfg.Store)
+	if err != nil {
+		log.Fatalf("failed to initialize file store: %s", err)
+	}
+
+	if *rotateKeys {
+		es, ok := fs.(*store.EncryptedStore)
+		if !ok {
+			log.Fatalf("store encryption is not configured")
+		}
+		n, err := es.Rotate(context.Background(), "")
+		if err != nil {
+			log.Fatalf("key rotation stopped after %d files: %s", n, err)
+		}
+		log.Printf("rotated %d files to key '%s'", n, cfg.Store.Encryption.KeyId)
+		store.Close(fs)
+		return
+	}
+
+	engine, err := expense.NewExpenseEngine(cfg, db, fs)
+	if err != nil {
+		log.Fatalf("failed to initialize expense engine: %s", err)
+	}
+
+	rest, err := web.NewRestService(cfg, db, fs, engine)
+	if err != nil {
+		log.Fatalf("failed to initialize REST service: %s", err)
+	}
+
+	err = engine.Recover()
+	if err != nil {
+		log.Fatalf("failed to recover unfinished receipts: %s", err)
+	}
+	go engine.Listen()
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: rest.Router,
+	}
+	go func() {
+		log.Printf("listening on %s", *addr)
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("REST service stopped: %s", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	log.Printf("shutting down, waiting up to %s for in-flight receipts", *shutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("failed to shut down REST service: %s", err)
+	}
+
+	err = engine.Shutdown(shutdownCtx)
+	if err != nil {
+		// aborted handlers may still be using the file store, leave it to the exit
+		log.Fatalf("failed to drain expense engine: %s", err)
+	}
+
+	err = store.Close(fs)
+	if err != nil {
+		log.Printf("failed to close file store: %s", err)
+	}
+}
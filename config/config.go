@@ -1,7 +1,10 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,27 +16,89 @@ const (
 
 const (
 	CUR_CURR_API = "currencyapi"
+	CUR_ECB      = "ecb"
+)
+
+const (
+	TR_GOOGLE         = "google"
+	TR_LIBRETRANSLATE = "libretranslate"
+	TR_DEEPL          = "deepl"
+	TR_GLOSSARY       = "glossary"
+	TR_NOOP           = "noop"
+)
+
+const (
+	CAT_RULES = "rules"
 )
 
 type Config struct {
-	App       AppCfg        `yaml:"app"`
-	Store     StorageCfg    `yaml:"store"`
-	Db        DbCfg         `yaml:"database"`
-	Currency  CurrencyCfg   `yaml:"currency"`
-	DocuAI    DocumentAICfg `yaml:"document-ai"`
-	DocuIntel DocuIntelCfg  `yaml:"docu-intel"`
-	Processor ProcessorCfg
+	App       AppCfg       `yaml:"app"`
+	Store     StorageCfg   `yaml:"store"`
+	Db        DbCfg        `yaml:"database"`
+	Queue     QueueCfg     `yaml:"queue"`
+	Pipeline  []StageCfg   `yaml:"pipeline"`
+	Transform TransformCfg `yaml:"transform"`
+	Currency  CurrencyCfg  `yaml:"currency"`
+	// Translation defaults to the google service with the document-ai credentials if omitted
+	Translation TranslationCfg `yaml:"translation"`
+	// Categories defaults to the rules classifier with the built-in rules if omitted
+	Categories CategoryCfg   `yaml:"categories"`
+	DocuAI     DocumentAICfg `yaml:"document-ai"`
+	DocuIntel  DocuIntelCfg  `yaml:"docu-intel"`
+	// Processors in the order they are tried. Built from AppCfg.Processors or AppCfg.ProcessorDriver.
+	Processors []ProcessorCfg `yaml:"-"`
 }
 
 type AppCfg struct {
-	Debug           bool   `yaml:"debug"`
-	Secret          string `yaml:"secret"`
-	ProcessorDriver string `yaml:"processor-driver"`
+	Debug           bool     `yaml:"debug"`
+	Secret          string   `yaml:"secret"`
+	ProcessorDriver string   `yaml:"processor-driver"`
+	Processors      []string `yaml:"processors"`
+	// Consensus sends every receipt to all processors and merges the results instead of falling back
+	Consensus bool `yaml:"consensus"`
 }
 
 type StorageCfg struct {
 	Driver   string `yaml:"driver"`
 	Location string `yaml:"location"`
+	// URLTTL is how long the URLs handed to processors stay valid. Defaults to 15m.
+	URLTTL time.Duration `yaml:"url-ttl"`
+	// PublicURL is the address processors reach the app on to download files of the os store
+	PublicURL string `yaml:"public-url"`
+	// Secret signs the download URLs of the os store. Copied from AppCfg.Secret.
+	Secret string `yaml:"-"`
+	// CredsFile is the service account of the gcloud store. Defaults to the Document AI credentials,
+	// application default credentials are used if neither is set.
+	CredsFile  string        `yaml:"credsfile"`
+	S3         S3Cfg         `yaml:"s3"`
+	Encryption EncryptionCfg `yaml:"encryption"`
+}
+
+// EncryptionCfg turns on client-side encryption of all stored files, whatever the driver
+type EncryptionCfg struct {
+	// KeyId of the master key new files are encrypted with. Encryption is off if empty.
+	KeyId string `yaml:"key-id"`
+	// Keys are base64 encoded 256 bit master keys by id. Retired keys are needed until the files are rotated to the current one.
+	Keys map[string]string `yaml:"keys"`
+	// KeyFile is a yaml file of more keys in the same format as Keys
+	KeyFile string `yaml:"key-file"`
+	// AllowPlaintext reads files stored before encryption was turned on as they are. Only needed until they are rotated.
+	AllowPlaintext bool `yaml:"allow-plaintext"`
+}
+
+// S3Cfg configures the s3 store. The bucket is the store location.
+type S3Cfg struct {
+	// Endpoint of an S3 compatible server like MinIO. Defaults to AWS S3, a missing scheme means https.
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	// AccessKey and SecretKey default to the AWS environment, credentials file or instance role
+	AccessKey string `yaml:"access-key"`
+	SecretKey string `yaml:"secret-key"`
+	// PathStyle addresses buckets as endpoint/bucket instead of bucket.endpoint, needed by most MinIO setups
+	PathStyle bool `yaml:"path-style"`
+	// SSE is the server-side encryption of stored files: AES256 or aws:kms
+	SSE      string `yaml:"sse"`
+	KMSKeyId string `yaml:"kms-key-id"`
 }
 
 type DbCfg struct {
@@ -45,10 +110,80 @@ type DbCfg struct {
 	Port     string `yaml:"port"`
 }
 
+type QueueCfg struct {
+	Driver       string        `yaml:"driver"`
+	Lease        time.Duration `yaml:"lease"`
+	PollInterval time.Duration `yaml:"poll-interval"`
+	MaxAttempts  int           `yaml:"max-attempts"`
+	Workers      int           `yaml:"workers"`
+	MaxPending   int           `yaml:"max-pending"`
+	RetryAfter   time.Duration `yaml:"retry-after"`
+}
+
+type StageCfg struct {
+	Name        string   `yaml:"name"`
+	Needs       []string `yaml:"needs"`
+	Concurrency int      `yaml:"concurrency"`
+}
+
+type TransformCfg struct {
+	// TaxTolerance is how far in major units of the currency the amounts may be off when checking that
+	// subtotal + tax = total. Defaults to one minor unit per tax line.
+	TaxTolerance float64 `yaml:"tax-tolerance"`
+}
+
 type CurrencyCfg struct {
 	Service  string `yaml:"service"`
 	Endpoint string `yaml:"endpoint"`
 	AuthKey  string `yaml:"auth-key"`
+	// Targets are the currencies expenses are converted into unless the tenant or the upload asks for others
+	Targets []string `yaml:"targets"`
+	// Tenants overrides Targets per tenant
+	Tenants map[string][]string `yaml:"tenants"`
+	// RatesFile is the ECB euro reference rates history in CSV or XML format used by the ecb service
+	RatesFile string `yaml:"rates-file"`
+	// Cache keeps fetched rates in the database so each day and currency pair is only requested once
+	Cache bool `yaml:"cache"`
+	// MinConfidence skips the conversion if the processor was less confident in the total or currency.
+	// A less confident date uses the latest rate, a less confident tax is not converted.
+	MinConfidence float64 `yaml:"min-confidence"`
+}
+
+type TranslationCfg struct {
+	Service string `yaml:"service"`
+	// Target is the language expenses are translated into. Defaults to en.
+	Target   string `yaml:"target"`
+	Endpoint string `yaml:"endpoint"`
+	AuthKey  string `yaml:"auth-key"`
+	// CredsFile is the service account used by the google service
+	CredsFile string `yaml:"credsfile"`
+	// Glossary is a yaml file of phrases and their translation used by the glossary service
+	Glossary string `yaml:"glossary"`
+	// Timeout of translating a receipt, also of a single request to a translation API
+	Timeout time.Duration `yaml:"timeout"`
+	// Fields is an allow-list of field keys to translate, * matches a line item index. Defaults to all text fields.
+	Fields []string `yaml:"fields"`
+	// MinConfidence leaves out text fields the processor was less confident in
+	MinConfidence float64 `yaml:"min-confidence"`
+}
+
+type CategoryCfg struct {
+	Service string `yaml:"service"`
+	// Default is the category of expenses no rule matches. Left empty if not set.
+	Default string `yaml:"default"`
+	// Rules replace the built-in rules of the rules classifier
+	Rules []CategoryRuleCfg `yaml:"rules"`
+}
+
+// CategoryRuleCfg matches an expense by whole words, case insensitive. The category with the most matches wins.
+type CategoryRuleCfg struct {
+	Category string `yaml:"category"`
+	// Merchants are matched against the merchant name and the merchant text and count the most
+	Merchants []string `yaml:"merchants"`
+	// Items are matched against each line item description
+	Items []string `yaml:"items"`
+	// Keywords are matched against all text fields, e.g. merchant category words like "restaurant" or "hotel"
+	Keywords []string `yaml:"keywords"`
 }
 
 type ProcessorCfg interface {
@@ -71,9 +206,9 @@ type DocuIntelCfg struct {
 
 const CONFIG_PATH = "config.yml"
 
-func LoadConfig() (Config, error) {
+func LoadConfig(path string) (Config, error) {
 	var cfg Config
-	cfgFile, err := os.Open(CONFIG_PATH)
+	cfgFile, err := os.Open(path)
 	if err != nil {
 		return cfg, err
 	}
@@ -85,17 +220,80 @@ func LoadConfig() (Config, error) {
 		return cfg, err
 	}
 
-	switch cfg.App.ProcessorDriver {
-	case SCHEMA_DOCUMENT_AI:
-		cfg.Processor = &cfg.DocuAI
-	case SCHEMA_DOC_INT:
-		cfg.Processor = &cfg.DocuIntel
+	cfg.Store.Secret = cfg.App.Secret
+	if cfg.Store.CredsFile == "" {
+		cfg.Store.CredsFile = cfg.DocuAI.CredsFile
+	}
+
+	drivers := cfg.App.Processors
+	if len(drivers) == 0 && cfg.App.ProcessorDriver != "" {
+		drivers = []string{cfg.App.ProcessorDriver}
+	}
+	for _, driver := range drivers {
+		switch driver {
+		case SCHEMA_DOCUMENT_AI:
+			cfg.Processors = append(cfg.Processors, &cfg.DocuAI)
+		case SCHEMA_DOC_INT:
+			cfg.Processors = append(cfg.Processors, &cfg.DocuIntel)
+		default:
+			return cfg, fmt.Errorf("unsupported processor driver: %s", driver)
+		}
+	}
+
+	if cfg.Translation.Service == "" {
+		cfg.Translation.Service = TR_GOOGLE
+		if cfg.Translation.CredsFile == "" {
+			cfg.Translation.CredsFile = cfg.DocuAI.CredsFile
+		}
+	}
+
+	if cfg.Categories.Service == "" {
+		cfg.Categories.Service = CAT_RULES
+	}
+
+	cfg.Currency.Targets, err = ParseCurrencies(cfg.Currency.Targets)
+	if err != nil {
+		return cfg, fmt.Errorf("currency targets: %w", err)
+	}
+	for tenant, targets := range cfg.Currency.Tenants {
+		cfg.Currency.Tenants[tenant], err = ParseCurrencies(targets)
+		if err != nil {
+			return cfg, fmt.Errorf("currency targets of tenant '%s': %w", tenant, err)
+		}
 	}
 
 	return cfg, nil
 
 }
 
+// ParseCurrencies upper-cases and de-duplicates currency codes. Values may be comma separated lists,
+// so both ?currency=USD&currency=GBP and ?currency=USD,GBP are accepted. Empty values are skipped.
+func ParseCurrencies(values []string) ([]string, error) {
+	var currencies []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, currency := range strings.Split(value, ",") {
+			currency = strings.ToUpper(strings.TrimSpace(currency))
+			if currency == "" {
+				continue
+			}
+			if len(currency) != 3 || strings.IndexFunc(currency, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+				return nil, fmt.Errorf("currency not in the three letter ISO format: '%s'", currency)
+			}
+			if seen[currency] {
+				continue
+			}
+			seen[currency] = true
+			currencies = append(currencies, currency)
+		}
+	}
+	return currencies, nil
+}
+
+func (cfg DbCfg) URL() string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name)
+}
+
 func (cfg *DocumentAICfg) Driver() string {
 	return SCHEMA_DOCUMENT_AI
 }
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCurrencies(t *testing.T) {
+	type testCase struct {
+		name       string
+		values     []string
+		want       []string
+		shouldFail bool
+	}
+
+	tcs := []testCase{
+		{
+			name:   "Repeated and comma separated",
+			values: []string{"USD", "GBP,eur"},
+			want:   []string{"USD", "GBP", "EUR"},
+		},
+		{
+			name:   "Duplicates",
+			values: []string{"usd", "USD, gbp", "GBP"},
+			want:   []string{"USD", "GBP"},
+		},
+		{
+			name:   "None",
+			values: nil,
+			want:   nil,
+		},
+		{
+			name:   "Empty value",
+			values: []string{""},
+			want:   nil,
+		},
+		{
+			name:   "Trailing comma",
+			values: []string{"USD,", " , gbp"},
+			want:   []string{"USD", "GBP"},
+		},
+		{
+			name:       "Not a code",
+			values:     []string{"USD,dollars"},
+			shouldFail: true,
+		},
+		{
+			name:       "Not letters",
+			values:     []string{"U$D"},
+			shouldFail: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		got, err := ParseCurrencies(tc.values)
+		if tc.shouldFail {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+}
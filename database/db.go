@@ -15,8 +15,12 @@ const (
 type DB interface {
 	Get(uuid.UUID) (Receipt, error)
 	GetByTags([]string) ([]Receipt, error)
+	GetByCategory(string) ([]Receipt, error)
+	GetNeedsReview() ([]Receipt, error)
+	GetUnfinished() ([]Receipt, error)
 	Create(Receipt) error
 	Update(Receipt) error
+	RateStore
 }
 
 func NewDataBase(cfg config.DbCfg) (DB, error) {
@@ -3,21 +3,28 @@ package database
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type InMemoryDb struct {
+	mu       sync.RWMutex
 	receipts map[uuid.UUID]Receipt
+	rates    map[string]Rate
 }
 
 func NewInMemoryDb() *InMemoryDb {
 	return &InMemoryDb{
 		receipts: make(map[uuid.UUID]Receipt),
+		rates:    make(map[string]Rate),
 	}
 }
 
 func (db *InMemoryDb) Get(id uuid.UUID) (Receipt, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	if receipt, ok := db.receipts[id]; ok {
 		return receipt, nil
 	}
@@ -29,7 +36,45 @@ func (db *InMemoryDb) GetByTags(tags []string) ([]Receipt, error) {
 	return nil, nil
 }
 
+func (db *InMemoryDb) GetByCategory(category string) ([]Receipt, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	receipts := make([]Receipt, 0)
+	for _, receipt := range db.receipts {
+		if receipt.Category == category {
+			receipts = append(receipts, receipt)
+		}
+	}
+	return receipts, nil
+}
+
+func (db *InMemoryDb) GetNeedsReview() ([]Receipt, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	receipts := make([]Receipt, 0)
+	for _, receipt := range db.receipts {
+		if receipt.NeedsReview {
+			receipts = append(receipts, receipt)
+		}
+	}
+	return receipts, nil
+}
+
+func (db *InMemoryDb) GetUnfinished() ([]Receipt, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	receipts := make([]Receipt, 0)
+	for _, receipt := range db.receipts {
+		if receipt.Status != S_DONE && receipt.Status != S_FAILED {
+			receipts = append(receipts, receipt)
+		}
+	}
+	return receipts, nil
+}
+
 func (db *InMemoryDb) Create(receipt Receipt) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	if _, ok := db.receipts[receipt.Id]; !ok {
 		db.receipts[receipt.Id] = receipt
 		return nil
@@ -38,9 +83,33 @@ func (db *InMemoryDb) Create(receipt Receipt) error {
 }
 
 func (db *InMemoryDb) Update(receipt Receipt) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	if _, ok := db.receipts[receipt.Id]; ok {
 		db.receipts[receipt.Id] = receipt
 		return nil
 	}
 	return errors.New("receipt not found")
 }
+
+func (db *InMemoryDb) GetRate(date time.Time, base, target string) (Rate, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if rate, ok := db.rates[rateKey(date, base, target)]; ok {
+		return rate, nil
+	}
+	return Rate{}, ErrRateNotFound
+}
+
+func (db *InMemoryDb) SaveRates(date time.Time, rates []Rate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, rate := range rates {
+		db.rates[rateKey(date, rate.Base, rate.Target)] = rate
+	}
+	return nil
+}
+
+func rateKey(date time.Time, base, target string) string {
+	return fmt.Sprintf("%s %s %s", rateDay(date), base, target)
+}
@@ -2,30 +2,58 @@ package database
 
 import (
 	"context"
+	_ "embed"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/likeawizard/document-ai-demo/config"
 )
 
+// schema creates the tables and upgrades the ones of earlier versions
+//
+//go:embed schema.sql
+var schema string
+
 type PostgresDb struct {
 	db *pgxpool.Pool
 }
 
 func NewPostgres(cfg config.DbCfg) (*PostgresDb, error) {
-	url := fmt.Sprintf("postgres://%s:%s@%s:%s/%s", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name)
-	conn, err := pgxpool.New(context.Background(), url)
+	conn, err := pgxpool.New(context.Background(), cfg.URL())
+	if err != nil {
+		return nil, err
+	}
+	ps := PostgresDb{db: conn}
+	err = ps.Migrate()
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return &PostgresDb{db: conn}, nil
+	return &ps, nil
+}
+
+// Pool is the connection pool of the database, shared with the postgres queue
+func (ps *PostgresDb) Pool() *pgxpool.Pool {
+	return ps.db
+}
+
+// Migrate applies schema.sql. All of its statements are idempotent so it is safe to run on every start.
+func (ps *PostgresDb) Migrate() error {
+	_, err := ps.db.Exec(context.Background(), schema)
+	if err != nil {
+		return fmt.Errorf("failed to migrate database schema: %w", err)
+	}
+	return nil
 }
 
 func (ps *PostgresDb) Get(id uuid.UUID) (Receipt, error) {
 	r := Receipt{}
-	sql := `SELECT r.id, r.filename, r.status, r.mime_type, r.path, t.name FROM receipts r
+	sql := `SELECT r.id, r.filename, r.status, r.mime_type, r.path, r.processor, r.tenant, r.currencies, r.stages, r.category, r.needs_review, t.name FROM receipts r
 		LEFT JOIN tags_to_receipts rel ON rel.receipt_id = r.id
 		LEFT JOIN tags t ON t.id = rel.tag_id
 		WHERE r.id = $1`
@@ -34,12 +62,23 @@ func (ps *PostgresDb) Get(id uuid.UUID) (Receipt, error) {
 		return r, fmt.Errorf("failed to retrieve receipt for id %s: %w", id, err)
 	}
 	for rows.Next() {
-		tag := ""
-		err := rows.Scan(&r.Id, &r.Filename, &r.Status, &r.MimeType, &r.Path, &tag)
+		var tag, processor, tenant, category *string
+		err := rows.Scan(&r.Id, &r.Filename, &r.Status, &r.MimeType, &r.Path, &processor, &tenant, &r.Currencies, &r.Stages, &category, &r.NeedsReview, &tag)
 		if err != nil {
 			continue
 		}
-		r.Tags = append(r.Tags, tag)
+		if processor != nil {
+			r.Processor = *processor
+		}
+		if tenant != nil {
+			r.Tenant = *tenant
+		}
+		if category != nil {
+			r.Category = *category
+		}
+		if tag != nil {
+			r.Tags = append(r.Tags, *tag)
+		}
 	}
 
 	if err != nil {
@@ -59,7 +98,7 @@ func (ps *PostgresDb) GetByTags(tags []string) ([]Receipt, error) {
 		args = append(args, v)
 	}
 
-	sql := fmt.Sprintf(`SELECT r.id, r.filename, r.status, r.mime_type, r.path, t.name FROM receipts r
+	sql := fmt.Sprintf(`SELECT r.id, r.filename, r.status, r.mime_type, r.path, COALESCE(r.category, ''), r.needs_review, t.name FROM receipts r
 		LEFT JOIN tags_to_receipts rel ON rel.receipt_id = r.id
 		LEFT JOIN tags t ON t.id = rel.tag_id
 		WHERE t.name IN (%s)`, strings.Join(placeholders, ", "))
@@ -73,7 +112,7 @@ func (ps *PostgresDb) GetByTags(tags []string) ([]Receipt, error) {
 	for rows.Next() {
 		var tmpReceipt Receipt
 		tag := ""
-		err := rows.Scan(&tmpReceipt.Id, &tmpReceipt.Filename, &tmpReceipt.Status, &tmpReceipt.MimeType, &tmpReceipt.Path, &tag)
+		err := rows.Scan(&tmpReceipt.Id, &tmpReceipt.Filename, &tmpReceipt.Status, &tmpReceipt.MimeType, &tmpReceipt.Path, &tmpReceipt.Category, &tmpReceipt.NeedsReview, &tag)
 		if err != nil {
 			continue
 		}
@@ -92,9 +131,78 @@ func (ps *PostgresDb) GetByTags(tags []string) ([]Receipt, error) {
 	return receipts, nil
 }
 
+// Returns receipts without tags in the category
+func (ps *PostgresDb) GetByCategory(category string) ([]Receipt, error) {
+	receipts := make([]Receipt, 0)
+	sql := `SELECT r.id, r.filename, r.status, r.mime_type, r.path, r.category, r.needs_review FROM receipts r
+		WHERE r.category = $1`
+	rows, err := ps.db.Query(context.Background(), sql, category)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve receipts in category %s: %w", category, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Receipt
+		err := rows.Scan(&r.Id, &r.Filename, &r.Status, &r.MimeType, &r.Path, &r.Category, &r.NeedsReview)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve receipts in category %s: %w", category, err)
+		}
+		receipts = append(receipts, r)
+	}
+
+	return receipts, rows.Err()
+}
+
+// Returns receipts without tags whose amounts do not add up
+func (ps *PostgresDb) GetNeedsReview() ([]Receipt, error) {
+	receipts := make([]Receipt, 0)
+	sql := `SELECT r.id, r.filename, r.status, r.mime_type, r.path, COALESCE(r.category, ''), r.needs_review FROM receipts r
+		WHERE r.needs_review`
+	rows, err := ps.db.Query(context.Background(), sql)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve receipts to review: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Receipt
+		err := rows.Scan(&r.Id, &r.Filename, &r.Status, &r.MimeType, &r.Path, &r.Category, &r.NeedsReview)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve receipts to review: %w", err)
+		}
+		receipts = append(receipts, r)
+	}
+
+	return receipts, rows.Err()
+}
+
+// Returns receipts without tags that have not reached a final status
+func (ps *PostgresDb) GetUnfinished() ([]Receipt, error) {
+	receipts := make([]Receipt, 0)
+	sql := `SELECT r.id, r.filename, r.status, r.mime_type, r.path, r.stages FROM receipts r
+		WHERE r.status NOT IN ($1, $2)`
+	rows, err := ps.db.Query(context.Background(), sql, S_DONE, S_FAILED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve unfinished receipts: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Receipt
+		err := rows.Scan(&r.Id, &r.Filename, &r.Status, &r.MimeType, &r.Path, &r.Stages)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve unfinished receipts: %w", err)
+		}
+		receipts = append(receipts, r)
+	}
+
+	return receipts, rows.Err()
+}
+
 func (ps *PostgresDb) Create(receipt Receipt) error {
-	sql := "INSERT INTO receipts (id, filename, status, mime_type, path) VALUES($1, $2, $3, $4, $5)"
-	_, err := ps.db.Exec(context.Background(), sql, receipt.Id, receipt.Filename, receipt.Status, receipt.MimeType, receipt.Path)
+	sql := "INSERT INTO receipts (id, filename, status, mime_type, path, processor, tenant, currencies, stages, category, needs_review) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"
+	_, err := ps.db.Exec(context.Background(), sql, receipt.Id, receipt.Filename, receipt.Status, receipt.MimeType, receipt.Path, receipt.Processor, receipt.Tenant, receipt.Currencies, receipt.Stages, receipt.Category, receipt.NeedsReview)
 	if err != nil {
 		return fmt.Errorf("failed to create new receipt with id %s: %w", receipt.Id, err)
 	}
@@ -103,8 +211,8 @@ func (ps *PostgresDb) Create(receipt Receipt) error {
 }
 
 func (ps *PostgresDb) Update(receipt Receipt) error {
-	sql := "UPDATE receipts SET filename=$1, status=$2, mime_type=$3, path=$4 WHERE id=$5"
-	_, err := ps.db.Exec(context.Background(), sql, receipt.Filename, receipt.Status, receipt.MimeType, receipt.Path, receipt.Id)
+	sql := "UPDATE receipts SET filename=$1, status=$2, mime_type=$3, path=$4, processor=$5, tenant=$6, currencies=$7, stages=$8, category=$9, needs_review=$10 WHERE id=$11"
+	_, err := ps.db.Exec(context.Background(), sql, receipt.Filename, receipt.Status, receipt.MimeType, receipt.Path, receipt.Processor, receipt.Tenant, receipt.Currencies, receipt.Stages, receipt.Category, receipt.NeedsReview, receipt.Id)
 	if err != nil {
 		return fmt.Errorf("failed to create new receipt with id %s: %w", receipt.Id, err)
 	}
@@ -139,3 +247,30 @@ func (ps *PostgresDb) setTags(id uuid.UUID, tags []string) error {
 	ps.db.Exec(context.Background(), linkSql, args...)
 	return nil
 }
+
+func (ps *PostgresDb) GetRate(date time.Time, base, target string) (Rate, error) {
+	r := Rate{Base: base, Target: target}
+	sql := "SELECT COALESCE(published, date), rate, provider FROM rates WHERE date = $1 AND base = $2 AND target = $3"
+	err := ps.db.QueryRow(context.Background(), sql, rateDay(date), base, target).Scan(&r.Date, &r.Value, &r.Provider)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return r, ErrRateNotFound
+	}
+	if err != nil {
+		return r, fmt.Errorf("failed to retrieve %s/%s rate for %s: %w", base, target, rateDay(date), err)
+	}
+	return r, nil
+}
+
+func (ps *PostgresDb) SaveRates(date time.Time, rates []Rate) error {
+	sql := `INSERT INTO rates (date, base, target, rate, provider, published) VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (date, base, target) DO UPDATE SET rate = EXCLUDED.rate, provider = EXCLUDED.provider, published = EXCLUDED.published`
+	batch := &pgx.Batch{}
+	for _, rate := range rates {
+		batch.Queue(sql, rateDay(date), rate.Base, rate.Target, rate.Value, rate.Provider, rateDay(rate.Date))
+	}
+	err := ps.db.SendBatch(context.Background(), batch).Close()
+	if err != nil {
+		return fmt.Errorf("failed to store exchange rates: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrRateNotFound = errors.New("exchange rate not found")
+
+// Rate is the exchange rate from Base into Target on Date as published by Provider
+type Rate struct {
+	Date     time.Time
+	Base     string
+	Target   string
+	Value    float64
+	Provider string
+}
+
+// RateStore caches exchange rates by day and currency pair
+type RateStore interface {
+	// GetRate returns ErrRateNotFound if the rate was never stored for date
+	GetRate(date time.Time, base, target string) (Rate, error)
+	// SaveRates stores the rates looked up for date. Rate.Date keeps the day they were published,
+	// which is earlier when no rates were published on date.
+	SaveRates(date time.Time, rates []Rate) error
+}
+
+func rateDay(date time.Time) string {
+	return date.Format("2006-01-02")
+}
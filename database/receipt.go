@@ -8,12 +8,20 @@ import (
 
 type Status string
 
+// Receipt statuses. How far the receipt got in the pipeline is kept in Receipt.Stages.
 const (
 	S_PENDING Status = "pending"
 	S_READY   Status = "ready"
+	S_DONE    Status = "done"
 	S_FAILED  Status = "failed"
 )
 
+// Statuses of receipts stored before the pipeline kept Receipt.Stages. Only read to resume them.
+const (
+	S_PROCESSED   Status = "processed"
+	S_TRANSFORMED Status = "transformed"
+)
+
 type Receipt struct {
 	Id       uuid.UUID `json:"id"`
 	Filename string    `json:"filename"`
@@ -21,6 +29,20 @@ type Receipt struct {
 	Tags     []string  `json:"tags,omitempty"`
 	MimeType string    `json:"mime_type"`
 	Path     string    `json:"path"`
+	// Processor is the schema of the processor that produced the raw json.
+	// In consensus mode a comma separated list of all processors that succeeded.
+	Processor string `json:"processor,omitempty"`
+	// Tenant the receipt was uploaded for, decides the default target currencies
+	Tenant string `json:"tenant,omitempty"`
+	// Currencies requested with the upload to convert the expense into. Empty means the tenant or config default.
+	Currencies []string `json:"currencies,omitempty"`
+	// Stages are the pipeline stages the receipt finished. The engine resumes from the first wave with a stage missing.
+	Stages []string `json:"stages,omitempty"`
+	// Category of the expense, copied from the expense so receipts can be queried by it
+	Category string `json:"category,omitempty"`
+	// NeedsReview is set by the transform stage if amounts of the expense do not add up or the processors disagreed,
+	// see transform.Expense.Issues and Review
+	NeedsReview bool `json:"needs_review,omitempty"`
 }
 
 func New(id uuid.UUID) Receipt {
@@ -34,6 +56,11 @@ func (r Receipt) GetJsonPath() string {
 	return fmt.Sprintf("%s.json", r.Id)
 }
 
+// GetRawPath is where the raw json of a single processor is kept when more than one processed the receipt
+func (r Receipt) GetRawPath(schema string) string {
+	return fmt.Sprintf("%s-%s.json", r.Id, schema)
+}
+
 func (r Receipt) GetExpensePath() string {
 	return fmt.Sprintf("%s-expense.json", r.Id)
 }
@@ -1,4 +1,6 @@
-CREATE TABLE receipts(
+-- Applied on every start, every statement must be idempotent. Columns added later are added with ALTER TABLE
+-- so databases created by earlier versions are upgraded in place.
+CREATE TABLE IF NOT EXISTS receipts(
     id uuid NOT NULL,
     filename text,
     status text,
@@ -7,14 +9,24 @@ CREATE TABLE receipts(
     PRIMARY KEY(id)
 );
 
-CREATE TABLE tags(
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS processor text;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS tenant text;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS currencies text[];
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS stages text[];
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS category text;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS needs_review boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_receipts_category ON receipts(category);
+CREATE INDEX IF NOT EXISTS idx_receipts_needs_review ON receipts(needs_review) WHERE needs_review;
+
+CREATE TABLE IF NOT EXISTS tags(
     id SERIAL NOT NULL,
     name text NOT NULL,
     PRIMARY KEY(id),
     UNIQUE(name)
 );
 
-CREATE TABLE tags_to_receipts(
+CREATE TABLE IF NOT EXISTS tags_to_receipts(
     id SERIAL NOT NULL,
     tag_id INT NOT NULL,
     receipt_id UUID NOT NULL,
@@ -24,4 +36,27 @@ CREATE TABLE tags_to_receipts(
     UNIQUE(tag_id, receipt_id)
 );
 
-CREATE INDEX IF NOT EXISTS idx_tags_name ON tags(name);
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_tags_name ON tags(name);
+
+CREATE TABLE IF NOT EXISTS events(
+    id BIGSERIAL NOT NULL,
+    receipt_id uuid NOT NULL,
+    msg text NOT NULL,
+    data jsonb,
+    attempts INT NOT NULL DEFAULT 0,
+    locked_until timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY(id),
+    CONSTRAINT fk_receipt FOREIGN KEY (receipt_id) REFERENCES receipts(id),
+    UNIQUE(receipt_id)
+);
+
+CREATE TABLE IF NOT EXISTS rates(
+    date date NOT NULL,
+    base text NOT NULL,
+    target text NOT NULL,
+    rate double precision NOT NULL,
+    provider text NOT NULL,
+    PRIMARY KEY(date, base, target)
+);
+-- date is the day the rate was looked up for, published the day it was published if that is an earlier business day
+ALTER TABLE rates ADD COLUMN IF NOT EXISTS published date;
@@ -1,201 +1,457 @@
 package expense
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/likeawizard/document-ai-demo/config"
 	"github.com/likeawizard/document-ai-demo/database"
 	"github.com/likeawizard/document-ai-demo/postprocess"
 	"github.com/likeawizard/document-ai-demo/processor"
+	"github.com/likeawizard/document-ai-demo/queue"
+	"github.com/likeawizard/document-ai-demo/store"
 	"github.com/likeawizard/document-ai-demo/transform"
 )
 
-type EventChan chan EventMsg
+var (
+	ErrShuttingDown = errors.New("expense engine is shutting down")
+	ErrQueueFull    = errors.New("too many receipts waiting to be processed")
+)
 
-type EventMsg struct {
-	Receipt database.Receipt
-	Msg     string
-	Data    map[string]string
+// Submitter accepts newly uploaded receipts into the processing pipeline.
+type Submitter interface {
+	// Accepting returns ErrQueueFull or ErrShuttingDown if a new receipt would be rejected.
+	Accepting() error
+	Submit(database.Receipt) error
 }
 
 type ExpenseEngine struct {
-	eventChan          EventChan
-	processService     *processor.ProcessorServcie
-	transformService   *transform.DataTransformService
-	postProcessService *postprocess.PostProcessService
-	Db                 database.DB
+	queue        queue.Queue
+	pollInterval time.Duration
+	maxAttempts  int
+	maxPending   int
+	services     Services
+	Db           database.DB
+	pipeline     *pipeline
+	stages       map[string]Stage
+	// legacyProcessor is the processor of receipts stored before the receipt recorded it
+	legacyProcessor string
+
+	workers sync.WaitGroup
+	// workerSlots bounds the number of events handled at the same time, stageSlots the same per stage
+	workerSlots chan struct{}
+	stageSlots  map[string]chan struct{}
+	mu          sync.Mutex
+	closing     bool
+	stop        chan struct{}
+	stopped     chan struct{}
+	closeOnce   sync.Once
+	// ctx is cancelled when Shutdown stops waiting, it aborts the stages still running
+	ctx   context.Context
+	abort context.CancelFunc
 }
 
 const (
-	msgNew         = "new"
-	msgProcessed   = "processed"
-	msgTransformed = "transformed"
-	msgDone        = "done"
-	msgFailed      = "failed"
+	msgNew    = "new"
+	msgStage  = "stage"
+	msgDone   = "done"
+	msgFailed = "failed"
+)
+
+const (
+	defaultPollInterval = time.Second
+	defaultMaxAttempts  = 3
+	defaultWorkers      = 16
 )
 
-func NewExpenseEngine(cfg config.Config) (*ExpenseEngine, error) {
+func NewExpenseEngine(cfg config.Config, db database.DB, fs store.FileStore) (*ExpenseEngine, error) {
 	pe := ExpenseEngine{
-		eventChan: make(chan EventMsg),
+		pollInterval: cfg.Queue.PollInterval,
+		maxAttempts:  cfg.Queue.MaxAttempts,
+		maxPending:   cfg.Queue.MaxPending,
+		Db:           db,
+		services:     Services{Db: db, FileStore: fs},
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	pe.ctx, pe.abort = context.WithCancel(context.Background())
+	if pe.pollInterval <= 0 {
+		pe.pollInterval = defaultPollInterval
 	}
-	ps, err := processor.NewProcessorService(cfg)
+	if pe.maxAttempts <= 0 {
+		pe.maxAttempts = defaultMaxAttempts
+	}
+	workers := cfg.Queue.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	pe.workerSlots = make(chan struct{}, workers)
+	if len(cfg.Processors) > 0 {
+		pe.legacyProcessor = cfg.Processors[0].Driver()
+	}
+
+	q, err := queue.NewQueue(cfg.Queue, db)
 	if err != nil {
 		return nil, err
 	}
-	pe.processService = ps
+	pe.queue = q
 
-	dts, err := transform.NewDataTransformService(cfg)
+	ps, err := processor.NewProcessorService(cfg, db, fs)
 	if err != nil {
 		return nil, err
 	}
-	pe.transformService = dts
+	pe.services.Processor = ps
 
-	db, err := database.NewDataBase(cfg.Db)
+	dts, err := transform.NewDataTransformService(cfg, fs)
 	if err != nil {
 		return nil, err
 	}
-	pe.Db = db
+	pe.services.Transform = dts
 
-	pps, err := postprocess.NewPostProcessService(cfg)
+	pps, err := postprocess.NewPostProcessService(cfg, db, fs)
 	if err != nil {
 		return nil, err
 	}
-	pe.postProcessService = pps
-
-	return &pe, nil
-}
+	pe.services.PostProcess = pps
 
-func (pe *ExpenseEngine) GetSendChan() EventChan {
-	return pe.eventChan
-}
+	pl, err := newPipeline(cfg.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+	pe.pipeline = pl
 
-func (pe *ExpenseEngine) Listen() {
-	for event := range pe.eventChan {
-		log.Printf("New event for %s with msg %s data : '%+v'", event.Receipt.Id, event.Msg, event.Data)
-		switch event.Msg {
-		case msgNew:
-			go pe.DispatchProcess(event.Receipt)
-		case msgProcessed:
-			go pe.DispatchDataTransform(event.Receipt, event.Data["schema"])
-		case msgTransformed:
-			go pe.DispatchPostProcess(event.Receipt)
-		case msgDone:
-			go pe.DispatchDone(event.Receipt)
-		case msgFailed:
-			go pe.DispatchFailed(event.Receipt, errors.New(event.Data["err"]))
-		default:
-			err := fmt.Errorf("unknown event message: '%s'", event.Msg)
-			go pe.DispatchFailed(event.Receipt, err)
+	pe.stages = make(map[string]Stage)
+	pe.stageSlots = make(map[string]chan struct{})
+	for _, wave := range pl.waves {
+		for _, name := range wave {
+			factory, _ := lookupStage(name)
+			pe.stages[name] = factory(pe.services)
+			if limit := pl.concurrency[name]; limit > 0 {
+				pe.stageSlots[name] = make(chan struct{}, limit)
+			}
 		}
 	}
+	err = pl.checkFields(pe.stages)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pe, nil
 }
 
-func (pe *ExpenseEngine) DispatchProcess(receipt database.Receipt) {
-	err := pe.processService.Process(receipt)
+func (pe *ExpenseEngine) Accepting() error {
+	pe.mu.Lock()
+	closing := pe.closing
+	pe.mu.Unlock()
+	if closing {
+		return ErrShuttingDown
+	}
+
+	if pe.maxPending <= 0 {
+		return nil
+	}
+	pending, err := pe.queue.Len()
 	if err != nil {
-		pe.eventChan.MsgFailed(receipt, err)
-		return
+		return err
 	}
-	receipt.Status = msgProcessed
-	pe.Db.Update(receipt)
-	pe.eventChan.MsgProcessed(receipt, pe.processService.Processor.Schema())
+	if pending >= pe.maxPending {
+		return ErrQueueFull
+	}
+	return nil
 }
 
-func (pe *ExpenseEngine) DispatchDataTransform(receipt database.Receipt, schema string) {
-	err := pe.transformService.Transform(receipt, schema)
+// Submit starts the pipeline for a newly uploaded receipt.
+func (pe *ExpenseEngine) Submit(receipt database.Receipt) error {
+	err := pe.Accepting()
 	if err != nil {
-		pe.eventChan.MsgFailed(receipt, err)
-		return
+		return err
 	}
-	receipt.Status = msgTransformed
-	pe.Db.Update(receipt)
-	pe.eventChan.MsgTransformed(receipt)
+
+	return pe.queue.Publish(newEvent(receipt, msgNew, nil))
 }
 
-func (pe *ExpenseEngine) DispatchPostProcess(receipt database.Receipt) {
-	file, err := pe.postProcessService.FileStore.Get(receipt.GetExpensePath())
+// Recover queues receipts that never reached done or failed, resuming them from the wave recorded in their status.
+// Receipts that still have an event in the queue are left as they are.
+func (pe *ExpenseEngine) Recover() error {
+	receipts, err := pe.Db.GetUnfinished()
 	if err != nil {
-		pe.eventChan.MsgFailed(receipt, err)
-		return
+		return err
 	}
-	defer file.Close()
 
-	data, err := io.ReadAll(file)
-	if err != nil {
-		pe.eventChan.MsgFailed(receipt, err)
-		return
+	for _, receipt := range receipts {
+		if pe.upgradeLegacy(&receipt) {
+			err = pe.Db.Update(receipt)
+			if err != nil {
+				return err
+			}
+		}
+
+		event := newEvent(receipt, msgNew, nil)
+		wave := pe.pipeline.resume(receipt.Stages)
+		switch {
+		case wave == len(pe.pipeline.waves):
+			event = newEvent(receipt, msgDone, nil)
+		case wave > 0:
+			event = waveEvent(receipt, wave)
+		}
+
+		err = pe.queue.Publish(event)
+		if err != nil {
+			return err
+		}
 	}
 
-	var exp transform.Expense
-	err = json.Unmarshal(data, &exp)
-	if err != nil {
-		pe.eventChan.MsgFailed(receipt, err)
-		return
+	if len(receipts) > 0 {
+		log.Printf("recovered %d unfinished receipts", len(receipts))
 	}
+	return nil
+}
 
-	cpp, err := pe.postProcessService.GetCurrencyPostProcess(exp)
-	if err == nil {
-		err = pe.postProcessService.CurrencyService.GetConversionRate(cpp)
-		if err == nil {
-			cpp.Apply(&exp)
+// upgradeLegacy maps the statuses of receipts stored before the pipeline kept the finished stages onto the stages,
+// so they are not sent to the processors again. Returns true if the receipt was changed.
+func (pe *ExpenseEngine) upgradeLegacy(receipt *database.Receipt) bool {
+	if len(receipt.Stages) > 0 {
+		return false
+	}
+	switch receipt.Status {
+	case database.S_PROCESSED:
+		receipt.Stages = []string{STAGE_PROCESS}
+	case database.S_TRANSFORMED:
+		receipt.Stages = []string{STAGE_PROCESS, STAGE_TRANSFORM}
+	default:
+		return false
+	}
+	receipt.Status = database.S_READY
+	if receipt.Processor == "" {
+		receipt.Processor = pe.legacyProcessor
+	}
+	return true
+}
+
+// Shutdown stops claiming new events, waits for the ones being handled to finish and closes the service clients.
+// Events that were not claimed stay in the queue and are picked up on the next start.
+// If ctx is done first the running stages are aborted, the service clients closed anyway and ctx.Err() returned.
+// Aborted events are not acknowledged and retried once their claim expires. The handlers may not have returned yet,
+// so the caller must not close the database or file store and should exit instead.
+func (pe *ExpenseEngine) Shutdown(ctx context.Context) error {
+	pe.mu.Lock()
+	if !pe.closing {
+		pe.closing = true
+		close(pe.stop)
+	}
+	pe.mu.Unlock()
+
+	select {
+	case <-pe.stopped:
+		pe.abort()
+		return pe.close()
+	case <-ctx.Done():
+		pe.abort()
+		err := pe.close()
+		if err != nil {
+			log.Printf("failed to close expense engine services: %s", err)
 		}
+		return ctx.Err()
 	}
+}
+
+// close releases the service clients. Only the first call closes them.
+func (pe *ExpenseEngine) close() error {
+	var err error
+	pe.closeOnce.Do(func() {
+		err = pe.services.Processor.Close()
+		if perr := pe.services.PostProcess.Close(); perr != nil && err == nil {
+			err = perr
+		}
+	})
+	return err
+}
+
+// Listen claims events from the queue and dispatches them until Shutdown is called.
+// Events are only claimed while a worker is free, the rest wait in the queue.
+func (pe *ExpenseEngine) Listen() {
+	defer close(pe.stopped)
+	for {
+		select {
+		case <-pe.stop:
+			pe.workers.Wait()
+			return
+		case pe.workerSlots <- struct{}{}:
+		}
 
-	tpp, err := pe.postProcessService.GetTranslationPostProcess(exp)
-	if err == nil {
-		err = pe.postProcessService.TranslationService.Translate(tpp)
-		if err == nil {
-			tpp.Apply(&exp)
+		event, err := pe.queue.Claim()
+		if err != nil {
+			<-pe.workerSlots
+			if !errors.Is(err, queue.ErrEmpty) {
+				log.Printf("failed to claim event: %s", err)
+			}
+			select {
+			case <-pe.stop:
+			case <-time.After(pe.pollInterval):
+			}
+			continue
 		}
+
+		pe.workers.Add(1)
+		go pe.handle(event)
 	}
+}
 
-	data, err = json.Marshal(exp)
-	if err != nil {
-		pe.eventChan.MsgFailed(receipt, err)
+func (pe *ExpenseEngine) handle(event queue.Message) {
+	defer func() { <-pe.workerSlots }()
+	defer pe.workers.Done()
+	log.Printf("New event for %s with msg %s data : '%+v'", event.ReceiptId, event.Msg, event.Data)
+
+	var next []queue.Message
+	var retry error
+	receipt, err := pe.Db.Get(event.ReceiptId)
+	switch {
+	case err != nil:
+		log.Printf("dropping event for %s: %s", event.ReceiptId, err)
+	case event.Attempts > pe.maxAttempts:
+		err = fmt.Errorf("giving up on '%s' after %d attempts", event.Msg, event.Attempts-1)
+		pe.DispatchFailed(receipt, err)
+	default:
+		next, retry = pe.dispatch(receipt, event)
+	}
+
+	if retry != nil {
+		log.Printf("event for %s is retried once its lease expires: %s", event.ReceiptId, retry)
+		return
+	}
+	if pe.ctx.Err() != nil {
+		log.Printf("shutdown aborted event for %s, it is retried on the next start", event.ReceiptId)
 		return
 	}
+	err = pe.queue.Ack(event, next...)
+	if err != nil {
+		log.Printf("failed to ack event for %s: %s", event.ReceiptId, err)
+	}
+}
+
+// dispatch handles an event and returns the events to publish with its ack. An error leaves the event unacknowledged
+// so it is delivered again.
+func (pe *ExpenseEngine) dispatch(receipt database.Receipt, event queue.Message) ([]queue.Message, error) {
+	switch event.Msg {
+	case msgNew:
+		next, err := pe.DispatchWave(receipt, 0)
+		return []queue.Message{next}, err
+	case msgStage:
+		wave, err := strconv.Atoi(event.Data["wave"])
+		if err != nil || wave < 0 || wave >= len(pe.pipeline.waves) {
+			pe.DispatchFailed(receipt, fmt.Errorf("invalid pipeline wave '%s'", event.Data["wave"]))
+			return nil, nil
+		}
+		next, err := pe.DispatchWave(receipt, wave)
+		return []queue.Message{next}, err
+	case msgDone:
+		pe.DispatchDone(receipt)
+	case msgFailed:
+		pe.DispatchFailed(receipt, errors.New(event.Data["err"]))
+	default:
+		err := fmt.Errorf("unknown event message: '%s'", event.Msg)
+		pe.DispatchFailed(receipt, err)
+	}
+	return nil, nil
+}
 
-	err = pe.postProcessService.FileStore.Store(receipt.GetExpensePath(), bytes.NewReader(data))
+// DispatchWave runs the stages of a pipeline wave the receipt has not finished yet in parallel and returns the event
+// for the next wave. Stages added to the wave since the receipt went through it are run on their own.
+// A stage failing with a processor.RecoverableError returns the error so the wave is retried, up to the queue max-attempts.
+// Other failures return the event that fails the receipt.
+func (pe *ExpenseEngine) DispatchWave(receipt database.Receipt, wave int) (queue.Message, error) {
+	names := unfinished(pe.pipeline.waves[wave], receipt.Stages)
+	err := pe.runWave(pe.ctx, &receipt, names)
+	if processor.IsRecoverable(err) {
+		return queue.Message{}, err
+	}
 	if err != nil {
-		pe.eventChan.MsgFailed(receipt, err)
-		return
+		return failedEvent(receipt, err), nil
 	}
 
-	pe.eventChan.MsgDone(receipt)
+	receipt.Stages = append(receipt.Stages, names...)
+	receipt.Status = database.S_READY
+	pe.Db.Update(receipt)
+
+	if wave+1 == len(pe.pipeline.waves) {
+		return newEvent(receipt, msgDone, nil), nil
+	}
+	return waveEvent(receipt, wave+1), nil
+}
+
+func (pe *ExpenseEngine) runWave(ctx context.Context, receipt *database.Receipt, names []string) error {
+	var exp *transform.Expense
+	for _, name := range names {
+		if pe.stages[name].Apply != nil {
+			var err error
+			exp, err = pe.services.PostProcess.LoadExpense(ctx, *receipt)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(names))
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string, stage Stage) {
+			defer wg.Done()
+			if slots, ok := pe.stageSlots[name]; ok {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
+			if stage.Run != nil {
+				errs[i] = stage.Run(ctx, receipt)
+			} else {
+				errs[i] = stage.Apply(ctx, receipt, exp)
+			}
+		}(i, name, pe.stages[name])
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("stage '%s' failed: %w", names[i], err)
+		}
+	}
+
+	if exp != nil {
+		for _, name := range names {
+			if update := pe.stages[name].UpdateReceipt; update != nil {
+				update(receipt, exp)
+			}
+		}
+		return pe.services.PostProcess.StoreExpense(ctx, *receipt, exp)
+	}
+	return nil
 }
 
 func (pe *ExpenseEngine) DispatchDone(receipt database.Receipt) {
-	receipt.Status = msgDone
+	receipt.Status = database.S_DONE
 	pe.Db.Update(receipt)
 }
 
 func (pe *ExpenseEngine) DispatchFailed(receipt database.Receipt, err error) {
 	log.Printf("process pipeline failed: %s", err)
-	receipt.Status = msgFailed
+	receipt.Status = database.S_FAILED
 	pe.Db.Update(receipt)
 }
 
-func (ec EventChan) MsgNew(receipt database.Receipt) {
-	ec <- EventMsg{Receipt: receipt, Msg: msgNew}
-}
-
-func (ec EventChan) MsgProcessed(receipt database.Receipt, schema string) {
-	ec <- EventMsg{Receipt: receipt, Msg: msgProcessed, Data: map[string]string{"schema": schema}}
-}
-
-func (ec EventChan) MsgTransformed(receipt database.Receipt) {
-	ec <- EventMsg{Receipt: receipt, Msg: msgTransformed}
+func newEvent(receipt database.Receipt, msg string, data map[string]string) queue.Message {
+	return queue.Message{ReceiptId: receipt.Id, Msg: msg, Data: data}
 }
 
-func (ec EventChan) MsgDone(receipt database.Receipt) {
-	ec <- EventMsg{Receipt: receipt, Msg: msgDone}
+func waveEvent(receipt database.Receipt, wave int) queue.Message {
+	return newEvent(receipt, msgStage, map[string]string{"wave": strconv.Itoa(wave)})
 }
 
-func (ec EventChan) MsgFailed(receipt database.Receipt, err error) {
-	ec <- EventMsg{Receipt: receipt, Msg: msgFailed, Data: map[string]string{"err": err.Error()}}
+func failedEvent(receipt database.Receipt, err error) queue.Message {
+	return newEvent(receipt, msgFailed, map[string]string{"err": err.Error()})
 }
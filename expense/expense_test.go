@@ -0,0 +1,210 @@
+package expense
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/processor"
+	"github.com/likeawizard/document-ai-demo/queue"
+	"github.com/likeawizard/document-ai-demo/store"
+	"github.com/likeawizard/document-ai-demo/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStage counts its runs and fails the first failures of them
+type countingStage struct {
+	mu       sync.Mutex
+	runs     int
+	failures int
+	err      error
+}
+
+func (cs *countingStage) run(ctx context.Context, receipt *database.Receipt) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.runs++
+	if cs.runs <= cs.failures {
+		return cs.err
+	}
+	return nil
+}
+
+// newTestEngine builds an engine on the in-memory queue and database with a process and a transform wave
+func newTestEngine(t *testing.T, maxAttempts int, process, transform *countingStage) *ExpenseEngine {
+	pl, err := newPipeline([]config.StageCfg{{Name: STAGE_PROCESS}, {Name: STAGE_TRANSFORM, Needs: []string{STAGE_PROCESS}}})
+	assert.NoError(t, err)
+
+	pe := ExpenseEngine{
+		// a zero lease delivers unacknowledged events again right away
+		queue:       queue.NewInMemoryQueue(0),
+		maxAttempts: maxAttempts,
+		Db:          database.NewInMemoryDb(),
+		pipeline:    pl,
+		stages: map[string]Stage{
+			STAGE_PROCESS:   {Run: process.run},
+			STAGE_TRANSFORM: {Run: transform.run},
+		},
+		workerSlots:     make(chan struct{}, 1),
+		stageSlots:      make(map[string]chan struct{}),
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+		legacyProcessor: config.SCHEMA_DOC_INT,
+	}
+	pe.ctx, pe.abort = context.WithCancel(context.Background())
+	t.Cleanup(pe.abort)
+	return &pe
+}
+
+// handleNext claims the next event and handles it like Listen does
+func handleNext(t *testing.T, pe *ExpenseEngine) queue.Message {
+	event, err := pe.queue.Claim()
+	assert.NoError(t, err)
+	pe.workerSlots <- struct{}{}
+	pe.workers.Add(1)
+	pe.handle(event)
+	return event
+}
+
+func drain(t *testing.T, pe *ExpenseEngine) {
+	for i := 0; i < 10; i++ {
+		if n, _ := pe.queue.Len(); n == 0 {
+			return
+		}
+		handleNext(t, pe)
+	}
+	t.Fatal("queue not drained")
+}
+
+func newTestReceipt(t *testing.T, pe *ExpenseEngine) database.Receipt {
+	receipt := database.New(uuid.New())
+	assert.NoError(t, pe.Db.Create(receipt))
+	return receipt
+}
+
+func TestEngineRedelivery(t *testing.T) {
+	process := &countingStage{failures: 1, err: &processor.RecoverableError{Err: errors.New("quota exceeded")}}
+	transform := &countingStage{}
+	pe := newTestEngine(t, 3, process, transform)
+	receipt := newTestReceipt(t, pe)
+	assert.NoError(t, pe.Submit(receipt))
+
+	event := handleNext(t, pe)
+	assert.Equal(t, msgNew, event.Msg)
+	n, err := pe.queue.Len()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n, "Not acknowledged after a recoverable failure")
+	got, _ := pe.Db.Get(receipt.Id)
+	assert.Equal(t, database.S_PENDING, got.Status)
+
+	event = handleNext(t, pe)
+	assert.Equal(t, msgNew, event.Msg, "Redelivered")
+	assert.Equal(t, 2, event.Attempts)
+
+	drain(t, pe)
+	got, _ = pe.Db.Get(receipt.Id)
+	assert.Equal(t, database.S_DONE, got.Status)
+	assert.Equal(t, []string{STAGE_PROCESS, STAGE_TRANSFORM}, got.Stages)
+	assert.Equal(t, 2, process.runs)
+	assert.Equal(t, 1, transform.runs)
+}
+
+func TestEngineFailure(t *testing.T) {
+	process := &countingStage{failures: 1, err: errors.New("not a receipt")}
+	transform := &countingStage{}
+	pe := newTestEngine(t, 3, process, transform)
+	receipt := newTestReceipt(t, pe)
+	assert.NoError(t, pe.Submit(receipt))
+
+	drain(t, pe)
+	got, _ := pe.Db.Get(receipt.Id)
+	assert.Equal(t, database.S_FAILED, got.Status, "Other errors fail the receipt right away")
+	assert.Equal(t, 1, process.runs)
+	assert.Equal(t, 0, transform.runs)
+}
+
+func TestEngineMaxAttempts(t *testing.T) {
+	process := &countingStage{failures: 10, err: &processor.RecoverableError{Err: errors.New("timeout")}}
+	transform := &countingStage{}
+	pe := newTestEngine(t, 2, process, transform)
+	receipt := newTestReceipt(t, pe)
+	assert.NoError(t, pe.Submit(receipt))
+
+	drain(t, pe)
+	got, _ := pe.Db.Get(receipt.Id)
+	assert.Equal(t, database.S_FAILED, got.Status, "Given up")
+	assert.Equal(t, 2, process.runs, "Delivered max-attempts times")
+	assert.Equal(t, 0, transform.runs)
+}
+
+func TestEngineRecover(t *testing.T) {
+	process := &countingStage{}
+	transform := &countingStage{}
+	pe := newTestEngine(t, 3, process, transform)
+
+	processed := database.New(uuid.New())
+	processed.Status = database.S_READY
+	processed.Processor = config.SCHEMA_DOCUMENT_AI
+	processed.Stages = []string{STAGE_PROCESS}
+	assert.NoError(t, pe.Db.Create(processed))
+	legacy := database.New(uuid.New())
+	legacy.Status = database.S_PROCESSED
+	assert.NoError(t, pe.Db.Create(legacy))
+	done := database.New(uuid.New())
+	done.Status = database.S_DONE
+	assert.NoError(t, pe.Db.Create(done))
+
+	assert.NoError(t, pe.Recover())
+	n, err := pe.queue.Len()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n, "Finished receipts are not recovered")
+
+	drain(t, pe)
+	assert.Equal(t, 0, process.runs, "Resumed after the last finished wave")
+	assert.Equal(t, 2, transform.runs)
+
+	got, _ := pe.Db.Get(processed.Id)
+	assert.Equal(t, database.S_DONE, got.Status)
+	assert.Equal(t, config.SCHEMA_DOCUMENT_AI, got.Processor)
+	got, _ = pe.Db.Get(legacy.Id)
+	assert.Equal(t, database.S_DONE, got.Status)
+	assert.Equal(t, []string{STAGE_PROCESS, STAGE_TRANSFORM}, got.Stages, "Legacy status mapped onto the stages")
+	assert.Equal(t, config.SCHEMA_DOC_INT, got.Processor, "Legacy receipts use the first configured processor")
+}
+
+func TestTransformStageConsensusReview(t *testing.T) {
+	dir := t.TempDir()
+	fs := store.NewSystemStore(config.StorageCfg{Location: dir})
+	receipt := database.New(uuid.New())
+	receipt.Processor = config.SCHEMA_DOC_INT + "," + config.SCHEMA_DOCUMENT_AI
+	for schema, fixture := range map[string]string{
+		config.SCHEMA_DOC_INT:     "docu_intel_receipt.json",
+		config.SCHEMA_DOCUMENT_AI: "document_ai_receipt.json",
+	} {
+		data, err := os.ReadFile(filepath.Join("..", "transform", "testdata", fixture))
+		assert.NoError(t, err)
+		assert.NoError(t, fs.Store(context.Background(), receipt.GetRawPath(schema), bytes.NewReader(data)))
+	}
+
+	dts, err := transform.NewDataTransformService(config.Config{Transform: config.TransformCfg{TaxTolerance: 100}}, fs)
+	assert.NoError(t, err)
+	stage := transformStage(Services{Transform: dts})
+	assert.NoError(t, stage.Run(context.Background(), &receipt))
+
+	r, err := fs.Get(context.Background(), receipt.GetExpensePath())
+	assert.NoError(t, err)
+	defer r.Close()
+	var exp transform.Expense
+	assert.NoError(t, json.NewDecoder(r).Decode(&exp))
+	assert.Empty(t, exp.Issues, "Amounts add up within the tolerance")
+	assert.NotEmpty(t, exp.Review)
+	assert.True(t, receipt.NeedsReview, "Processor disagreements are flagged")
+}
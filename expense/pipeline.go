@@ -0,0 +1,207 @@
+package expense
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/postprocess"
+	"github.com/likeawizard/document-ai-demo/processor"
+	"github.com/likeawizard/document-ai-demo/store"
+	"github.com/likeawizard/document-ai-demo/transform"
+)
+
+// Stage is a single named step of the pipeline. Exactly one of Run or Apply is set.
+type Stage struct {
+	// Run works on the receipt and its stored files. Stages in the same wave must not modify the same receipt fields.
+	Run func(context.Context, *database.Receipt) error
+	// Apply post-processes the transformed expense. Stages in the same wave share one expense which is stored once all of them finish.
+	Apply func(context.Context, *database.Receipt, *transform.Expense) error
+	// Reads and Writes are the expense field keys an Apply stage uses. A stage must not write a field
+	// that another stage of the same wave reads or writes.
+	Reads  []string
+	Writes []string
+	// UpdateReceipt copies fields of the expense to the receipt once all Apply stages of the wave finished. Optional.
+	UpdateReceipt func(*database.Receipt, *transform.Expense)
+}
+
+// Services are the engine services stages are built from
+type Services struct {
+	Processor   *processor.ProcessorServcie
+	Transform   *transform.DataTransformService
+	PostProcess *postprocess.PostProcessService
+	Db          database.DB
+	FileStore   store.FileStore
+}
+
+// StageFactory builds a stage from the engine services.
+type StageFactory func(Services) Stage
+
+var stageRegistry = make(map[string]StageFactory)
+
+// RegisterStage makes a stage available to be used by name in the pipeline config.
+func RegisterStage(name string, factory StageFactory) {
+	if _, ok := stageRegistry[name]; ok {
+		panic(fmt.Sprintf("pipeline stage '%s' registered twice", name))
+	}
+	stageRegistry[name] = factory
+}
+
+// lookupStage returns the factory of a registered stage. Registered post-processors are stages of the same name,
+// they are looked up when the pipeline is built so post-processors registered after this package are found too.
+func lookupStage(name string) (StageFactory, bool) {
+	if factory, ok := stageRegistry[name]; ok {
+		return factory, true
+	}
+	if reg, ok := postprocess.Lookup(name); ok {
+		return postProcessStage(reg), true
+	}
+	return nil, false
+}
+
+var defaultPipeline = []config.StageCfg{
+	{Name: STAGE_PROCESS},
+	{Name: STAGE_TRANSFORM, Needs: []string{STAGE_PROCESS}},
+	{Name: STAGE_CURRENCY, Needs: []string{STAGE_TRANSFORM}},
+	{Name: STAGE_TRANSLATION, Needs: []string{STAGE_TRANSFORM}},
+	{Name: STAGE_CATEGORY, Needs: []string{STAGE_TRANSFORM}},
+}
+
+// pipeline is the stage DAG resolved into waves. All stages of a wave only depend on stages of earlier waves
+// and are run in parallel.
+type pipeline struct {
+	waves [][]string
+	// concurrency is the max number of receipts a stage works on at the same time. Zero means unlimited.
+	concurrency map[string]int
+}
+
+func newPipeline(stages []config.StageCfg) (*pipeline, error) {
+	if len(stages) == 0 {
+		stages = defaultPipeline
+	}
+
+	p := pipeline{concurrency: make(map[string]int, len(stages))}
+	needs := make(map[string][]string, len(stages))
+	for _, stage := range stages {
+		if _, ok := lookupStage(stage.Name); !ok {
+			return nil, fmt.Errorf("unknown pipeline stage '%s'", stage.Name)
+		}
+		if _, ok := needs[stage.Name]; ok {
+			return nil, fmt.Errorf("pipeline stage '%s' declared twice", stage.Name)
+		}
+		needs[stage.Name] = stage.Needs
+		p.concurrency[stage.Name] = stage.Concurrency
+	}
+	for name, deps := range needs {
+		for _, dep := range deps {
+			if _, ok := needs[dep]; !ok {
+				return nil, fmt.Errorf("pipeline stage '%s' needs undeclared stage '%s'", name, dep)
+			}
+		}
+	}
+
+	done := make(map[string]bool, len(stages))
+	for len(done) < len(stages) {
+		wave := make([]string, 0)
+		for _, stage := range stages {
+			if !done[stage.Name] && allDone(stage.Needs, done) {
+				wave = append(wave, stage.Name)
+			}
+		}
+		if len(wave) == 0 {
+			return nil, fmt.Errorf("pipeline has a dependency cycle")
+		}
+		for _, name := range wave {
+			done[name] = true
+		}
+		p.waves = append(p.waves, wave)
+	}
+
+	return &p, nil
+}
+
+func allDone(needs []string, done map[string]bool) bool {
+	for _, name := range needs {
+		if !done[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// resume returns the first wave with a stage that is not finished, len(waves) if all are
+func (p *pipeline) resume(finished []string) int {
+	done := stageSet(finished)
+	for i, wave := range p.waves {
+		if !allDone(wave, done) {
+			return i
+		}
+	}
+	return len(p.waves)
+}
+
+// unfinished returns the stages of the wave that are not finished yet
+func unfinished(wave, finished []string) []string {
+	done := stageSet(finished)
+	names := make([]string, 0, len(wave))
+	for _, name := range wave {
+		if !done[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func stageSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// checkFields makes sure no stage writes an expense field that another stage of the same wave reads or writes
+func (p *pipeline) checkFields(stages map[string]Stage) error {
+	for _, wave := range p.waves {
+		for _, name := range wave {
+			for _, other := range wave {
+				if other == name {
+					continue
+				}
+				for _, field := range stages[name].Writes {
+					if f, ok := overlaps(field, stages[other].Writes); ok {
+						return fmt.Errorf("pipeline stages '%s' and '%s' both write '%s'", name, other, f)
+					}
+					if f, ok := overlaps(field, stages[other].Reads); ok {
+						return fmt.Errorf("pipeline stage '%s' writes '%s' read by '%s' in the same wave", name, f, other)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// overlaps returns the first of the fields that refers to the same data as field. Fields overlap if
+// they match each other, see path.Match, or one is nested in the other, e.g. line_items and line_items.0.description.
+func overlaps(field string, fields []string) (string, bool) {
+	for _, f := range fields {
+		if matchField(field, f) || matchField(f, field) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+func matchField(pattern, field string) bool {
+	parts := strings.Split(field, ".")
+	for i := range parts {
+		if ok, _ := path.Match(pattern, strings.Join(parts[:i+1], ".")); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package expense
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/postprocess"
+	"github.com/likeawizard/document-ai-demo/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPipeline(t *testing.T) {
+	type testCase struct {
+		name       string
+		stages     []config.StageCfg
+		want       [][]string
+		shouldFail bool
+	}
+
+	tcs := []testCase{
+		{
+			name:   "Default pipeline",
+			stages: nil,
+			want:   [][]string{{STAGE_PROCESS}, {STAGE_TRANSFORM}, {STAGE_CURRENCY, STAGE_TRANSLATION, STAGE_CATEGORY}},
+		},
+		{
+			name: "Linear",
+			stages: []config.StageCfg{
+				{Name: STAGE_PROCESS},
+				{Name: STAGE_TRANSFORM, Needs: []string{STAGE_PROCESS}},
+				{Name: STAGE_TRANSLATION, Needs: []string{STAGE_TRANSFORM}},
+				{Name: STAGE_CURRENCY, Needs: []string{STAGE_TRANSLATION}},
+			},
+			want: [][]string{{STAGE_PROCESS}, {STAGE_TRANSFORM}, {STAGE_TRANSLATION}, {STAGE_CURRENCY}},
+		},
+		{
+			name: "Declaration order does not matter",
+			stages: []config.StageCfg{
+				{Name: STAGE_TRANSFORM, Needs: []string{STAGE_PROCESS}},
+				{Name: STAGE_PROCESS},
+			},
+			want: [][]string{{STAGE_PROCESS}, {STAGE_TRANSFORM}},
+		},
+		{
+			name:       "Unknown stage",
+			stages:     []config.StageCfg{{Name: "teleport"}},
+			shouldFail: true,
+		},
+		{
+			name:       "Undeclared dependency",
+			stages:     []config.StageCfg{{Name: STAGE_TRANSFORM, Needs: []string{STAGE_PROCESS}}},
+			shouldFail: true,
+		},
+		{
+			name:       "Duplicate stage",
+			stages:     []config.StageCfg{{Name: STAGE_PROCESS}, {Name: STAGE_PROCESS}},
+			shouldFail: true,
+		},
+		{
+			name: "Cycle",
+			stages: []config.StageCfg{
+				{Name: STAGE_PROCESS, Needs: []string{STAGE_TRANSFORM}},
+				{Name: STAGE_TRANSFORM, Needs: []string{STAGE_PROCESS}},
+			},
+			shouldFail: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		p, err := newPipeline(tc.stages)
+		if tc.shouldFail {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.want, p.waves, tc.name)
+	}
+}
+
+func TestPipelineLateRegistration(t *testing.T) {
+	_, err := newPipeline([]config.StageCfg{{Name: "stamp"}})
+	assert.Error(t, err, "Not registered yet")
+
+	// post-processors registered after the package was initialized, e.g. by a plugin, are found when the pipeline is built
+	postprocess.RegisterPostProcessor(postprocess.Registration{
+		Name:   "stamp",
+		Writes: []string{transform.FIELD_CATEGORY},
+		New: func(context.Context, *postprocess.PostProcessService, database.Receipt, *transform.Expense) (postprocess.PostProcessor, error) {
+			return nil, errors.New("not applied")
+		},
+		UpdateReceipt: func(receipt *database.Receipt, exp *transform.Expense) {
+			receipt.Category = exp.Category
+		},
+	})
+	p, err := newPipeline([]config.StageCfg{{Name: STAGE_PROCESS}, {Name: STAGE_TRANSFORM, Needs: []string{STAGE_PROCESS}}, {Name: "stamp", Needs: []string{STAGE_TRANSFORM}}})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{STAGE_PROCESS}, {STAGE_TRANSFORM}, {"stamp"}}, p.waves)
+	factory, ok := lookupStage("stamp")
+	assert.True(t, ok)
+	stage := factory(Services{})
+	assert.Equal(t, []string{transform.FIELD_CATEGORY}, stage.Writes)
+	receipt := database.Receipt{}
+	stage.UpdateReceipt(&receipt, &transform.Expense{Category: "stamps"})
+	assert.Equal(t, "stamps", receipt.Category, "Receipt columns are updated by the registration")
+}
+
+func TestPipelineResume(t *testing.T) {
+	p, err := newPipeline(nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, p.resume(nil), "Pending")
+	assert.Equal(t, 1, p.resume([]string{STAGE_PROCESS}), "Processed")
+	assert.Equal(t, 3, p.resume([]string{STAGE_PROCESS, STAGE_TRANSFORM, STAGE_CURRENCY, STAGE_TRANSLATION, STAGE_CATEGORY}), "Last wave finished")
+	assert.Equal(t, 2, p.resume([]string{STAGE_PROCESS, STAGE_TRANSFORM, STAGE_CURRENCY, STAGE_TRANSLATION}), "Stage added to a finished wave")
+	assert.Equal(t, 0, p.resume([]string{"teleport"}), "Unknown stage")
+
+	assert.Equal(t, []string{STAGE_CATEGORY}, unfinished(p.waves[2], []string{STAGE_PROCESS, STAGE_TRANSFORM, STAGE_CURRENCY, STAGE_TRANSLATION}), "Only the added stage runs")
+}
+
+func TestPipelineCheckFields(t *testing.T) {
+	stages := []config.StageCfg{
+		{Name: STAGE_TRANSFORM},
+		{Name: STAGE_CURRENCY, Needs: []string{STAGE_TRANSFORM}},
+		{Name: STAGE_TRANSLATION, Needs: []string{STAGE_TRANSFORM}},
+	}
+	p, err := newPipeline(stages)
+	assert.NoError(t, err)
+
+	registered := map[string]Stage{
+		STAGE_TRANSFORM:   {},
+		STAGE_CURRENCY:    {Reads: []string{transform.FIELD_TOTAL}, Writes: []string{transform.FIELD_CONVERSIONS}},
+		STAGE_TRANSLATION: {Reads: []string{transform.FIELD_LANGUAGE, "line_items.*.description"}, Writes: []string{transform.FIELD_TRANSLATION}},
+	}
+	assert.NoError(t, p.checkFields(registered), "Disjoint fields")
+
+	conflicts := map[string]Stage{
+		"Same field":        {Writes: []string{transform.FIELD_TRANSLATION}},
+		"Read field":        {Writes: []string{transform.FIELD_LANGUAGE}},
+		"Nested field":      {Writes: []string{transform.FIELD_LINE_ITEMS}},
+		"Matched line item": {Writes: []string{transform.ItemField(3, transform.ITEM_DESCRIPTION)}},
+	}
+	for name, stage := range conflicts {
+		registered[STAGE_CURRENCY] = stage
+		assert.Error(t, p.checkFields(registered), name)
+	}
+}
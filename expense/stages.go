@@ -0,0 +1,62 @@
+package expense
+
+import (
+	"context"
+
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/postprocess"
+	"github.com/likeawizard/document-ai-demo/transform"
+)
+
+const (
+	STAGE_PROCESS     = "process"
+	STAGE_TRANSFORM   = "transform"
+	STAGE_CURRENCY    = postprocess.PP_CURRENCY
+	STAGE_TRANSLATION = postprocess.PP_TRANSLATION
+	STAGE_CATEGORY    = postprocess.PP_CATEGORY
+)
+
+func init() {
+	RegisterStage(STAGE_PROCESS, processStage)
+	RegisterStage(STAGE_TRANSFORM, transformStage)
+}
+
+// processStage sends the receipt to the document processors and stores the raw result.
+// Records the processor that produced it on the receipt.
+func processStage(services Services) Stage {
+	return Stage{Run: func(ctx context.Context, receipt *database.Receipt) error {
+		schema, err := services.Processor.Process(ctx, *receipt)
+		if err != nil {
+			return err
+		}
+		receipt.Processor = schema
+		return nil
+	}}
+}
+
+// transformStage parses the raw processor result into the common Expense using the schema of the processor that produced it.
+// Flags the receipt for review if the amounts of the expense do not add up or the processors disagreed.
+func transformStage(services Services) Stage {
+	return Stage{Run: func(ctx context.Context, receipt *database.Receipt) error {
+		exp, err := services.Transform.Transform(ctx, *receipt)
+		if err != nil {
+			return err
+		}
+		receipt.NeedsReview = exp.NeedsReview()
+		return nil
+	}}
+}
+
+// postProcessStage applies a registered post-processor to the transformed expense
+func postProcessStage(reg postprocess.Registration) StageFactory {
+	return func(services Services) Stage {
+		return Stage{
+			Reads:  reg.Reads,
+			Writes: reg.Writes,
+			Apply: func(ctx context.Context, receipt *database.Receipt, exp *transform.Expense) error {
+				return services.PostProcess.Run(ctx, reg.Name, *receipt, exp)
+			},
+			UpdateReceipt: reg.UpdateReceipt,
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package postprocess
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/transform"
+)
+
+const (
+	CATEGORY_MEALS   = "meals"
+	CATEGORY_TRAVEL  = "travel"
+	CATEGORY_LODGING = "lodging"
+	CATEGORY_FUEL    = "fuel"
+	CATEGORY_OFFICE  = "office_supplies"
+)
+
+type Classifier interface {
+	// Classify returns the category of the expense text fields by field key, see transform.Expense.TextFields.
+	// Returns an error if no category fits.
+	Classify(FieldMap) (string, error)
+}
+
+// ClassifierFactory builds a classifier from the categories config
+type ClassifierFactory func(config.CategoryCfg) (Classifier, error)
+
+var classifiers = make(map[string]ClassifierFactory)
+
+// RegisterClassifier makes a classifier available to be selected with the categories service in the config
+func RegisterClassifier(service string, factory ClassifierFactory) {
+	if _, ok := classifiers[service]; ok {
+		panic(fmt.Sprintf("classifier '%s' registered twice", service))
+	}
+	classifiers[service] = factory
+}
+
+// NewClassifier builds the classifier registered for the configured service
+func NewClassifier(cfg config.CategoryCfg) (Classifier, error) {
+	factory, ok := classifiers[cfg.Service]
+	if !ok {
+		return nil, fmt.Errorf("unsupported category service: '%s'", cfg.Service)
+	}
+	return factory(cfg)
+}
+
+type CategoryPostProcess struct {
+	// fields are the merchant fields and line item descriptions by field key
+	fields   FieldMap
+	category string
+}
+
+func init() {
+	RegisterPostProcessor(Registration{
+		Name: PP_CATEGORY,
+		Reads: []string{
+			transform.FIELD_MERCHANT_STRING,
+			transform.FIELD_MERCHANT_NAME,
+			transform.FIELD_MERCHANT_ADDRESS,
+			transform.FIELD_LINE_ITEMS + ".*." + transform.ITEM_DESCRIPTION,
+		},
+		Writes: []string{transform.FIELD_CATEGORY},
+		New:    newCategoryPostProcessor,
+		UpdateReceipt: func(receipt *database.Receipt, exp *transform.Expense) {
+			receipt.Category = exp.Category
+		},
+	})
+}
+
+// newCategoryPostProcessor picks the expense category. Skipped if nothing on the receipt hints at one.
+func newCategoryPostProcessor(ctx context.Context, pps *PostProcessService, receipt database.Receipt, exp *transform.Expense) (PostProcessor, error) {
+	cpp := NewCategoryPostProcess()
+	err := cpp.GetFields(exp)
+	if err != nil {
+		return nil, err
+	}
+	cpp.category, err = pps.Classifier.Classify(cpp.fields)
+	if err != nil {
+		return nil, err
+	}
+	return cpp, nil
+}
+
+func NewCategoryPostProcess() *CategoryPostProcess {
+	return &CategoryPostProcess{}
+}
+
+func (pp *CategoryPostProcess) GetFields(exp *transform.Expense) error {
+	pp.fields = exp.TextFields()
+	// the payment type says nothing about what was bought and "Bar" is cash in German
+	delete(pp.fields, transform.FIELD_PAYMENT_TYPE)
+	if len(pp.fields) == 0 {
+		return fmt.Errorf("nothing to categorize")
+	}
+	return nil
+}
+
+func (pp *CategoryPostProcess) Apply(exp *transform.Expense) {
+	exp.Category = pp.category
+}
@@ -0,0 +1,107 @@
+package postprocess
+
+import (
+	"testing"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuleClassifier(t *testing.T) {
+	type testCase struct {
+		name string
+		exp  transform.Expense
+		want string
+	}
+
+	tcs := []testCase{
+		{
+			name: "Merchant",
+			exp:  transform.Expense{Merchant: transform.Merchant{MerchantName: "Aral Tankstelle Berlin"}},
+			want: CATEGORY_FUEL,
+		},
+		{
+			name: "Line items",
+			exp: transform.Expense{
+				Merchant:  transform.Merchant{MerchantName: "Zur Linde"},
+				LineItems: []transform.LineItem{{Description: "Kaffee"}, {Description: "Pizza Margherita"}},
+			},
+			want: CATEGORY_MEALS,
+		},
+		{
+			name: "Merchant outweighs a single item",
+			exp: transform.Expense{
+				Merchant:  transform.Merchant{MerchantName: "Hotel Adlon"},
+				LineItems: []transform.LineItem{{Description: "Übernachtung"}, {Description: "Coffee"}},
+			},
+			want: CATEGORY_LODGING,
+		},
+		{
+			name: "Whole words only",
+			exp:  transform.Expense{Merchant: transform.Merchant{MerchantName: "Shellfish Market"}},
+			want: "",
+		},
+		{
+			name: "Cash payment is not a bar",
+			exp:  transform.Expense{Merchant: transform.Merchant{MerchantName: "Kiosk"}, PaymentType: "Bar"},
+			want: "",
+		},
+	}
+
+	rc, err := NewRuleClassifier(config.CategoryCfg{})
+	assert.NoError(t, err)
+	for _, tc := range tcs {
+		cpp := NewCategoryPostProcess()
+		err := cpp.GetFields(&tc.exp)
+		assert.NoError(t, err, tc.name)
+		cpp.category, err = rc.Classify(cpp.fields)
+		if tc.want == "" {
+			assert.Error(t, err, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		cpp.Apply(&tc.exp)
+		assert.Equal(t, tc.want, tc.exp.Category, tc.name)
+	}
+}
+
+func TestRuleClassifierConfig(t *testing.T) {
+	rc, err := NewRuleClassifier(config.CategoryCfg{
+		Default: "other",
+		Rules:   []config.CategoryRuleCfg{{Category: "software", Keywords: []string{"license", "subscription"}}},
+	})
+	assert.NoError(t, err)
+
+	exp := transform.Expense{LineItems: []transform.LineItem{{Description: "Annual subscription"}}}
+	category, err := rc.Classify(exp.TextFields())
+	assert.NoError(t, err)
+	assert.Equal(t, "software", category)
+
+	category, err = rc.Classify(FieldMap{transform.FIELD_MERCHANT_NAME: "Restaurant"})
+	assert.NoError(t, err)
+	assert.Equal(t, "other", category, "Configured rules replace the built-in ones")
+
+	_, err = NewRuleClassifier(config.CategoryCfg{Rules: []config.CategoryRuleCfg{{Keywords: []string{"x"}}}})
+	assert.Error(t, err, "Rule without category")
+}
+
+type staticClassifier string
+
+func (sc staticClassifier) Classify(FieldMap) (string, error) {
+	return string(sc), nil
+}
+
+func TestRegisterClassifier(t *testing.T) {
+	_, err := NewClassifier(config.CategoryCfg{Service: "static"})
+	assert.Error(t, err, "Not registered")
+
+	RegisterClassifier("static", func(cfg config.CategoryCfg) (Classifier, error) {
+		return staticClassifier(cfg.Default), nil
+	})
+	c, err := NewClassifier(config.CategoryCfg{Service: "static", Default: "software"})
+	assert.NoError(t, err)
+	category, err := c.Classify(FieldMap{transform.FIELD_MERCHANT_NAME: "Kiosk"})
+	assert.NoError(t, err)
+	assert.Equal(t, "software", category)
+}
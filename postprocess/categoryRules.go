@@ -0,0 +1,131 @@
+package postprocess
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/transform"
+)
+
+// Weights of the rule matches. A merchant match is a stronger hint than a single item.
+const (
+	merchantWeight = 3
+	itemWeight     = 1
+	keywordWeight  = 1
+)
+
+// defaultCategoryRules are used if the config does not list any
+var defaultCategoryRules = []config.CategoryRuleCfg{
+	{
+		Category:  CATEGORY_FUEL,
+		Merchants: []string{"shell", "aral", "esso", "bp", "totalenergies", "texaco", "chevron", "omv", "q8", "jet", "agip", "avia"},
+		Items:     []string{"diesel", "petrol", "gasoline", "unleaded", "benzin", "super e10", "super 95", "super plus", "adblue", "e10", "e5"},
+		Keywords:  []string{"fuel", "tankstelle", "gas station", "filling station", "station service", "carburant"},
+	},
+	{
+		Category:  CATEGORY_LODGING,
+		Merchants: []string{"hotel", "hostel", "motel", "marriott", "hilton", "ibis", "novotel", "holiday inn", "hyatt", "airbnb", "best western"},
+		Items:     []string{"room", "overnight stay", "night", "übernachtung", "city tax", "tourist tax", "nuitée", "taxe de séjour"},
+		Keywords:  []string{"hotel", "hostel", "motel", "inn", "lodging", "accommodation", "check in", "check out", "pension"},
+	},
+	{
+		Category:  CATEGORY_TRAVEL,
+		Merchants: []string{"deutsche bahn", "sncf", "trenitalia", "renfe", "amtrak", "lufthansa", "british airways", "ryanair", "easyjet", "uber", "lyft", "bolt", "flixbus"},
+		Items:     []string{"ticket", "fahrkarte", "fahrschein", "boarding pass", "fare", "flight", "train", "bus", "taxi", "parking", "toll", "car rental", "mietwagen"},
+		Keywords:  []string{"airline", "airport", "flughafen", "taxi", "railway", "bahn", "parking", "parkhaus", "car rental", "mietwagen"},
+	},
+	{
+		Category:  CATEGORY_MEALS,
+		Merchants: []string{"restaurant", "ristorante", "trattoria", "pizzeria", "bistro", "brasserie", "cafe", "café", "starbucks", "mcdonald s", "burger king", "gasthaus"},
+		Items:     []string{"coffee", "kaffee", "cappuccino", "latte", "espresso", "tea", "pizza", "pasta", "burger", "sandwich", "salad", "soup", "beer", "bier", "wine", "wein", "water", "wasser", "menu", "dessert"},
+		Keywords:  []string{"restaurant", "pub", "diner", "catering", "tip", "gratuity", "trinkgeld", "table", "tisch"},
+	},
+	{
+		Category:  CATEGORY_OFFICE,
+		Merchants: []string{"staples", "office depot", "officeworks", "viking", "mcpaper"},
+		Items:     []string{"paper", "papier", "pen", "pens", "kugelschreiber", "toner", "ink", "cartridge", "stapler", "notebook", "envelope", "folder", "ordner", "post it", "printer"},
+		Keywords:  []string{"stationery", "office supplies", "bürobedarf", "schreibwaren", "papeterie"},
+	},
+}
+
+// RuleClassifier picks the category whose rules match the expense best. Ties go to the rule listed first.
+type RuleClassifier struct {
+	rules []config.CategoryRuleCfg
+	// fallback is the category if no rule matches
+	fallback string
+}
+
+func init() {
+	RegisterClassifier(config.CAT_RULES, func(cfg config.CategoryCfg) (Classifier, error) {
+		return NewRuleClassifier(cfg)
+	})
+}
+
+func NewRuleClassifier(cfg config.CategoryCfg) (*RuleClassifier, error) {
+	rc := RuleClassifier{rules: cfg.Rules, fallback: cfg.Default}
+	if len(rc.rules) == 0 {
+		rc.rules = defaultCategoryRules
+	}
+	for _, rule := range rc.rules {
+		if rule.Category == "" {
+			return nil, fmt.Errorf("category rule without a category")
+		}
+	}
+	return &rc, nil
+}
+
+func (rc *RuleClassifier) Classify(fields FieldMap) (string, error) {
+	merchant := words(fields[transform.FIELD_MERCHANT_NAME] + " " + fields[transform.FIELD_MERCHANT_STRING])
+	items := make([]string, 0)
+	all := make([]string, 0, len(fields))
+	for k, v := range fields {
+		if strings.HasPrefix(k, transform.FIELD_LINE_ITEMS+".") {
+			items = append(items, words(v))
+		}
+		all = append(all, v)
+	}
+	text := words(strings.Join(all, " "))
+
+	best, bestScore := "", 0
+	for _, rule := range rc.rules {
+		score := merchantWeight*countWords(merchant, rule.Merchants) + keywordWeight*countWords(text, rule.Keywords)
+		for _, item := range items {
+			if countWords(item, rule.Items) > 0 {
+				score += itemWeight
+			}
+		}
+		if score > bestScore {
+			best, bestScore = rule.Category, score
+		}
+	}
+
+	switch {
+	case best != "":
+		return best, nil
+	case rc.fallback != "":
+		return rc.fallback, nil
+	default:
+		return "", fmt.Errorf("no category rule matches")
+	}
+}
+
+// words lower cases the text and replaces everything but letters and digits with single spaces.
+// The result is padded with spaces so whole words can be found with strings.Contains.
+func words(text string) string {
+	return " " + strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ") + " "
+}
+
+// countWords returns how many of the phrases are found as whole words in the text built by words
+func countWords(text string, phrases []string) int {
+	count := 0
+	for _, phrase := range phrases {
+		if p := words(phrase); p != "  " && strings.Contains(text, p) {
+			count++
+		}
+	}
+	return count
+}
@@ -1,73 +1,147 @@
 package postprocess
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
 	"github.com/likeawizard/document-ai-demo/transform"
 )
 
 const (
-	TARGET_CURRENCY = "EUR"
+	// DEFAULT_TARGET_CURRENCY is used if neither the config, the tenant nor the upload name a target currency
+	DEFAULT_TARGET_CURRENCY = "EUR"
 )
 
 type CurrencyService interface {
+	// GetConversionRate sets the rate from the expense currency to each of the targets.
+	// The service picks the day of the rate for the expense date, see resolveRateDate.
 	GetConversionRate(*CurrencyPostProcess) error
 }
 
 type CurrencyPostProcess struct {
-	rate     float64
 	date     time.Time
 	currency string
+	targets  []string
 	fields   FieldMap
+	// minConfidence of the processor in the fields to convert
+	minConfidence float64
+	// rates by target currency as set by the CurrencyService
+	rates map[string]database.Rate
 }
 
-func NewCurrencyService(cfg config.CurrencyCfg) (CurrencyService, error) {
+func init() {
+	RegisterPostProcessor(Registration{
+		Name:   PP_CURRENCY,
+		Reads:  []string{transform.FIELD_DATE, transform.FIELD_CURRENCY, transform.FIELD_TOTAL, transform.FIELD_TAX},
+		Writes: []string{transform.FIELD_CONVERSIONS},
+		New:    newCurrencyPostProcessor,
+	})
+}
+
+// newCurrencyPostProcessor converts money values into the target currencies of the receipt.
+// Skipped if the expense is missing the data to convert.
+func newCurrencyPostProcessor(ctx context.Context, pps *PostProcessService, receipt database.Receipt, exp *transform.Expense) (PostProcessor, error) {
+	cpp, err := pps.GetCurrencyPostProcess(receipt, exp)
+	if err != nil {
+		return nil, err
+	}
+	err = pps.CurrencyService.GetConversionRate(cpp)
+	if err != nil {
+		return nil, err
+	}
+	return cpp, nil
+}
+
+func NewCurrencyService(cfg config.CurrencyCfg, db database.RateStore) (CurrencyService, error) {
+	var cs CurrencyService
 	switch cfg.Service {
 	case config.CUR_CURR_API:
-		return NewCurrencyApiService(cfg), nil
+		cs = NewCurrencyApiService(cfg)
+	case config.CUR_ECB:
+		ecb, err := NewEcbService(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cs = ecb
 	default:
 		return nil, fmt.Errorf("unsupported currency service: '%s'", cfg.Service)
 	}
+
+	if cfg.Cache {
+		cs = NewCachedCurrencyService(cs, db)
+	}
+	return cs, nil
 }
 
-func (pp *CurrencyPostProcess) GetFields(exp transform.Expense) error {
+func NewCurrencyPostProcess(targets []string) *CurrencyPostProcess {
+	return &CurrencyPostProcess{targets: targets}
+}
+
+// GetFields collects the values to convert. Targets in the expense currency are dropped as there is nothing to convert.
+func (pp *CurrencyPostProcess) GetFields(exp *transform.Expense) error {
+	targets := make([]string, 0, len(pp.targets))
+	for _, target := range pp.targets {
+		if target != exp.Currency {
+			targets = append(targets, target)
+		}
+	}
+	pp.targets = targets
+
 	switch {
-	case exp.Currency == TARGET_CURRENCY:
+	case len(pp.targets) == 0:
 		return fmt.Errorf("nothing to convert")
 	case len(exp.Currency) != 3:
 		return fmt.Errorf("currency not in the three letter ISO format: '%s'", exp.Currency)
-	case exp.Total == 0:
+	case exp.Total.IsZero():
 		return fmt.Errorf("nothing to convert total is zero")
+	case lowConfidence(exp, transform.FIELD_TOTAL, pp.minConfidence):
+		return fmt.Errorf("total confidence %g below %g", exp.Confidence(transform.FIELD_TOTAL), pp.minConfidence)
+	case lowConfidence(exp, transform.FIELD_CURRENCY, pp.minConfidence):
+		return fmt.Errorf("currency confidence %g below %g", exp.Confidence(transform.FIELD_CURRENCY), pp.minConfidence)
 	}
 
-	if exp.Date.IsZero() {
-		// TODO historic rates are available only for dates until last midnight. Should be handled in API call - set past date there or query live currency rate
-		pp.date = time.Now().Add(-1 * 24 * time.Hour)
-	} else {
+	// a missing or doubtful date is left zero, the CurrencyService uses the latest rate for it
+	if !lowConfidence(exp, transform.FIELD_DATE, pp.minConfidence) {
 		pp.date = exp.Date
 	}
 
 	pp.currency = exp.Currency
 
 	pp.fields = FieldMap{
-		"total": fmt.Sprintf("%f", exp.Total),
-		"tax":   fmt.Sprintf("%f", exp.Tax),
+		"total": exp.Total.String(),
+	}
+	if !lowConfidence(exp, transform.FIELD_TAX, pp.minConfidence) {
+		pp.fields["tax"] = exp.Tax.String()
 	}
 
 	return nil
 }
 
+// Apply records the converted values next to the original ones, which are left as printed on the receipt
 func (pp *CurrencyPostProcess) Apply(exp *transform.Expense) {
-	for k := range pp.fields {
-		switch k {
-		case "tax":
-			exp.Tax *= pp.rate
-		case "total":
-			exp.Total *= pp.rate
+	exp.Conversions = nil
+	for _, target := range pp.targets {
+		rate, ok := pp.rates[target]
+		if !ok {
+			continue
+		}
+		conversion := transform.Conversion{
+			Currency: target,
+			Rate:     rate.Value,
+			RateDate: rate.Date,
+			Provider: rate.Provider,
 		}
+		for k := range pp.fields {
+			switch k {
+			case "tax":
+				conversion.Tax = exp.Tax.Convert(rate.Value, target)
+			case "total":
+				conversion.Total = exp.Total.Convert(rate.Value, target)
+			}
+		}
+		exp.Conversions = append(exp.Conversions, conversion)
 	}
-
-	exp.Currency = TARGET_CURRENCY
 }
@@ -0,0 +1,101 @@
+package postprocess
+
+import (
+	"testing"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/transform"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrencyPostProcessKeepsOriginal(t *testing.T) {
+	exp := &transform.Expense{
+		Date:     time.Date(2023, 9, 20, 12, 15, 0, 0, time.UTC),
+		Currency: "GBP",
+		Total:    transform.Money{Amount: 805, Currency: "GBP"},
+		Tax:      transform.Money{Amount: 134, Currency: "GBP"},
+	}
+
+	cpp := NewCurrencyPostProcess([]string{"EUR", "GBP", "USD"})
+	err := cpp.GetFields(exp)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EUR", "USD"}, cpp.targets, "Nothing to convert into the expense currency")
+
+	rateDate := time.Date(2023, 9, 20, 0, 0, 0, 0, time.UTC)
+	cpp.rates = map[string]database.Rate{
+		"EUR": {Date: rateDate, Base: "GBP", Target: "EUR", Value: 1.1535, Provider: "test"},
+		"USD": {Date: rateDate, Base: "GBP", Target: "USD", Value: 1.2369, Provider: "test"},
+	}
+	cpp.Apply(exp)
+
+	assert.Equal(t, "GBP", exp.Currency, "Original currency is kept")
+	assert.Equal(t, "8.05", exp.Total.String(), "Original total is kept")
+	assert.Equal(t, "1.34", exp.Tax.String(), "Original tax is kept")
+
+	assert.Equal(t, []transform.Conversion{
+		{
+			Currency: "EUR",
+			Rate:     1.1535,
+			RateDate: rateDate,
+			Provider: "test",
+			Total:    transform.Money{Amount: 929, Currency: "EUR"},
+			Tax:      transform.Money{Amount: 155, Currency: "EUR"},
+		},
+		{
+			Currency: "USD",
+			Rate:     1.2369,
+			RateDate: rateDate,
+			Provider: "test",
+			Total:    transform.Money{Amount: 996, Currency: "USD"},
+			Tax:      transform.Money{Amount: 166, Currency: "USD"},
+		},
+	}, exp.Conversions)
+}
+
+func TestTargetCurrencies(t *testing.T) {
+	cfg := config.Config{
+		Currency: config.CurrencyCfg{
+			Service: config.CUR_CURR_API,
+			Targets: []string{"EUR"},
+			Tenants: map[string][]string{"us": {"USD"}},
+		},
+		Translation: config.TranslationCfg{Service: config.TR_NOOP},
+		Categories:  config.CategoryCfg{Service: config.CAT_RULES},
+	}
+	pps, err := NewPostProcessService(cfg, database.NewInMemoryDb(), nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"EUR"}, pps.TargetCurrencies(database.Receipt{}), "Config default")
+	assert.Equal(t, []string{"USD"}, pps.TargetCurrencies(database.Receipt{Tenant: "us"}), "Tenant override")
+	assert.Equal(t, []string{"EUR"}, pps.TargetCurrencies(database.Receipt{Tenant: "unknown"}), "Unknown tenant uses the default")
+	assert.Equal(t, []string{"GBP", "JPY"}, pps.TargetCurrencies(database.Receipt{Tenant: "us", Currencies: []string{"GBP", "JPY"}}), "Upload override")
+}
+
+func TestCurrencyPostProcessMinConfidence(t *testing.T) {
+	exp := &transform.Expense{
+		Date:     time.Date(2023, 9, 20, 12, 15, 0, 0, time.UTC),
+		Currency: "GBP",
+		Total:    transform.Money{Amount: 805, Currency: "GBP"},
+		Tax:      transform.Money{Amount: 134, Currency: "GBP"},
+		Sources: map[string]transform.Source{
+			transform.FIELD_TOTAL: {Confidence: 0.98},
+			transform.FIELD_DATE:  {Confidence: 0.3},
+			transform.FIELD_TAX:   {Confidence: 0.5},
+		},
+	}
+
+	cpp := NewCurrencyPostProcess([]string{"EUR"})
+	cpp.minConfidence = 0.8
+	err := cpp.GetFields(exp)
+	assert.NoError(t, err)
+	assert.True(t, cpp.date.IsZero(), "Doubtful date uses the latest rate")
+	assert.Equal(t, FieldMap{"total": "8.05"}, cpp.fields, "Doubtful tax is not converted")
+
+	exp.Sources[transform.FIELD_TOTAL] = transform.Source{Confidence: 0.6}
+	cpp = NewCurrencyPostProcess([]string{"EUR"})
+	cpp.minConfidence = 0.8
+	err = cpp.GetFields(exp)
+	assert.Error(t, err, "Doubtful total is skipped")
+}
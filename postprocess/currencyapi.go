@@ -6,9 +6,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
 )
 
 type CurrencyApiService struct {
@@ -31,6 +33,12 @@ func (cs *CurrencyApiService) getHistoricalPath() string {
 	return "/v3/historical"
 }
 
+func (cs *CurrencyApiService) getLatestPath() string {
+	return "/v3/latest"
+}
+
+// GetConversionRate queries historical rates for past business days. Those are only available up to the last midnight
+// so expenses from today, the future or without a date use the latest rates.
 func (cs *CurrencyApiService) GetConversionRate(cpp *CurrencyPostProcess) error {
 	type response struct {
 		Meta struct {
@@ -42,10 +50,13 @@ func (cs *CurrencyApiService) GetConversionRate(cpp *CurrencyPostProcess) error
 		} `json:"data"`
 	}
 
+	day, latest := resolveRateDate(cpp.date)
 	params := url.Values{}
-	params.Add("date", cpp.date.Format("2006-01-02"))
+	if !latest {
+		params.Add("date", day.Format("2006-01-02"))
+	}
 	params.Add("base_currency", cpp.currency)
-	params.Add("currencies", TARGET_CURRENCY)
+	params.Add("currencies", strings.Join(cpp.targets, ","))
 	params.Add("apikey", cs.authKey)
 
 	u, err := url.ParseRequestURI(cs.endpoint)
@@ -54,6 +65,9 @@ func (cs *CurrencyApiService) GetConversionRate(cpp *CurrencyPostProcess) error
 	}
 
 	u.Path = cs.getHistoricalPath()
+	if latest {
+		u.Path = cs.getLatestPath()
+	}
 	u.RawQuery = params.Encode()
 
 	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
@@ -79,12 +93,24 @@ func (cs *CurrencyApiService) GetConversionRate(cpp *CurrencyPostProcess) error
 		return err
 	}
 
-	conversionData, ok := currencyData.Data[TARGET_CURRENCY]
-	if !ok {
-		return fmt.Errorf("requested currency conversion missing '%s'", TARGET_CURRENCY)
+	rateDate := day
+	if latest && !currencyData.Meta.LastUpdatedAt.IsZero() {
+		rateDate = toDay(currencyData.Meta.LastUpdatedAt.UTC())
+	}
+	cpp.rates = make(map[string]database.Rate, len(cpp.targets))
+	for _, target := range cpp.targets {
+		conversionData, ok := currencyData.Data[target]
+		if !ok {
+			return fmt.Errorf("requested currency conversion missing '%s'", target)
+		}
+		cpp.rates[target] = database.Rate{
+			Date:     rateDate,
+			Base:     cpp.currency,
+			Target:   target,
+			Value:    conversionData.Value,
+			Provider: config.CUR_CURR_API,
+		}
 	}
-
-	cpp.rate = conversionData.Value
 
 	return nil
 }
@@ -0,0 +1,84 @@
+package postprocess
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/likeawizard/document-ai-demo/config"
+)
+
+const deeplEndpoint = "https://api-free.deepl.com"
+
+type DeeplService struct {
+	client   *http.Client
+	endpoint string
+	authKey  string
+}
+
+func NewDeeplService(cfg config.TranslationCfg, client *http.Client) *DeeplService {
+	ts := DeeplService{
+		client:   client,
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"),
+		authKey:  cfg.AuthKey,
+	}
+	if ts.endpoint == "" {
+		ts.endpoint = deeplEndpoint
+	}
+	return &ts
+}
+
+func (ts *DeeplService) Translate(ctx context.Context, tpp *TranslationPostProcess) error {
+	type request struct {
+		Text       []string `json:"text"`
+		TargetLang string   `json:"target_lang"`
+	}
+	type response struct {
+		Translations []struct {
+			DetectedSourceLanguage string `json:"detected_source_language"`
+			Text                   string `json:"text"`
+		} `json:"translations"`
+		Message string `json:"message"`
+	}
+
+	keys, vals := tpp.batch()
+	if len(vals) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(request{Text: vals, TargetLang: strings.ToUpper(tpp.lang.String())})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.endpoint+"/v2/translate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+ts.authKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to translate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var translated response
+	err = json.NewDecoder(resp.Body).Decode(&translated)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to translate: %s: %s", resp.Status, translated.Message)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to translate: %w", err)
+	}
+
+	texts := make([]string, len(translated.Translations))
+	for i, t := range translated.Translations {
+		texts[i] = t.Text
+	}
+	return tpp.setTranslations(keys, texts)
+}
@@ -0,0 +1,160 @@
+package postprocess
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+)
+
+const ecbBase = "EUR"
+
+// EcbService converts with the ECB euro foreign exchange reference rates loaded from disk.
+// Works offline with the history files from https://www.ecb.europa.eu/stats/eurofxref/eurofxref-hist.zip
+type EcbService struct {
+	// rates against the euro by day and currency
+	rates map[string]map[string]float64
+	// days with rates in ascending order
+	days []string
+}
+
+func NewEcbService(cfg config.CurrencyCfg) (*EcbService, error) {
+	f, err := os.Open(cfg.RatesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ECB rates: %w", err)
+	}
+	defer f.Close()
+
+	var rates map[string]map[string]float64
+	switch strings.ToLower(filepath.Ext(cfg.RatesFile)) {
+	case ".csv":
+		rates, err = parseEcbCsv(f)
+	case ".xml":
+		rates, err = parseEcbXml(f)
+	default:
+		return nil, fmt.Errorf("unsupported ECB rates file '%s', expected csv or xml", cfg.RatesFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ECB rates '%s': %w", cfg.RatesFile, err)
+	}
+
+	cs := EcbService{rates: rates, days: make([]string, 0, len(rates))}
+	for day := range rates {
+		cs.days = append(cs.days, day)
+	}
+	sort.Strings(cs.days)
+
+	return &cs, nil
+}
+
+// GetConversionRate uses the rates of the last day published on or before the resolved rate date.
+// That also covers holidays resolveRateDate does not know about and files that were not updated recently.
+func (cs *EcbService) GetConversionRate(cpp *CurrencyPostProcess) error {
+	resolved, _ := resolveRateDate(cpp.date)
+	i := sort.SearchStrings(cs.days, resolved.Format("2006-01-02"))
+	if i == len(cs.days) || cs.days[i] != resolved.Format("2006-01-02") {
+		i--
+	}
+	if i < 0 {
+		return fmt.Errorf("no ECB reference rates on or before %s", resolved.Format("2006-01-02"))
+	}
+	day := cs.days[i]
+	rates := cs.rates[day]
+
+	base, ok := ecbRate(rates, cpp.currency)
+	if !ok {
+		return fmt.Errorf("no ECB reference rate for '%s' on %s", cpp.currency, day)
+	}
+
+	date, _ := time.Parse("2006-01-02", day)
+	cpp.rates = make(map[string]database.Rate, len(cpp.targets))
+	for _, target := range cpp.targets {
+		rate, ok := ecbRate(rates, target)
+		if !ok {
+			return fmt.Errorf("no ECB reference rate for '%s' on %s", target, day)
+		}
+		cpp.rates[target] = database.Rate{
+			Date:     date,
+			Base:     cpp.currency,
+			Target:   target,
+			Value:    rate / base,
+			Provider: config.CUR_ECB,
+		}
+	}
+
+	return nil
+}
+
+func ecbRate(rates map[string]float64, currency string) (float64, bool) {
+	if currency == ecbBase {
+		return 1, true
+	}
+	rate, ok := rates[currency]
+	return rate, ok
+}
+
+// parseEcbCsv reads the eurofxref-hist.csv format: a Date column followed by a column per currency, N/A for missing rates
+func parseEcbCsv(r io.Reader) (map[string]map[string]float64, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 1 || len(records[0]) < 1 || records[0][0] != "Date" {
+		return nil, fmt.Errorf("missing Date header")
+	}
+
+	header := records[0]
+	rates := make(map[string]map[string]float64, len(records)-1)
+	for _, record := range records[1:] {
+		day := make(map[string]float64, len(record)-1)
+		for i := 1; i < len(record) && i < len(header); i++ {
+			rate, err := strconv.ParseFloat(strings.TrimSpace(record[i]), 64)
+			if err != nil {
+				continue
+			}
+			day[strings.TrimSpace(header[i])] = rate
+		}
+		rates[record[0]] = day
+	}
+
+	return rates, nil
+}
+
+// parseEcbXml reads the eurofxref-hist.xml format: <Cube time="2023-09-20"><Cube currency="USD" rate="1.0679"/>...</Cube>
+func parseEcbXml(r io.Reader) (map[string]map[string]float64, error) {
+	var envelope struct {
+		Days []struct {
+			Time  string `xml:"time,attr"`
+			Rates []struct {
+				Currency string  `xml:"currency,attr"`
+				Rate     float64 `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube>Cube"`
+	}
+	err := xml.NewDecoder(r).Decode(&envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	rates := make(map[string]map[string]float64, len(envelope.Days))
+	for _, d := range envelope.Days {
+		day := make(map[string]float64, len(d.Rates))
+		for _, rate := range d.Rates {
+			day[rate.Currency] = rate.Rate
+		}
+		rates[d.Time] = day
+	}
+
+	return rates, nil
+}
@@ -0,0 +1,80 @@
+package postprocess
+
+import (
+	"testing"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEcbService(t *testing.T) {
+	for _, file := range []string{"testdata/eurofxref-hist.csv", "testdata/eurofxref-hist.xml"} {
+		cs, err := NewEcbService(config.CurrencyCfg{Service: config.CUR_ECB, RatesFile: file})
+		assert.NoError(t, err, file)
+
+		cpp := NewCurrencyPostProcess([]string{"EUR", "USD", "JPY"})
+		cpp.currency = "GBP"
+		cpp.date = time.Date(2023, 9, 20, 12, 15, 0, 0, time.UTC)
+		err = cs.GetConversionRate(cpp)
+		assert.NoError(t, err, file)
+
+		assert.InDelta(t, 1/0.86590, cpp.rates["EUR"].Value, 1e-9, file)
+		assert.InDelta(t, 1.0679/0.86590, cpp.rates["USD"].Value, 1e-9, file)
+		assert.InDelta(t, 157.63/0.86590, cpp.rates["JPY"].Value, 1e-9, file)
+		assert.Equal(t, time.Date(2023, 9, 20, 0, 0, 0, 0, time.UTC), cpp.rates["USD"].Date, file)
+		assert.Equal(t, config.CUR_ECB, cpp.rates["USD"].Provider, file)
+
+		cpp = NewCurrencyPostProcess([]string{"CYP"})
+		cpp.currency = "EUR"
+		cpp.date = time.Date(2023, 9, 20, 0, 0, 0, 0, time.UTC)
+		err = cs.GetConversionRate(cpp)
+		assert.Error(t, err, "Currency without a rate")
+	}
+}
+
+func TestEcbServiceRateDate(t *testing.T) {
+	now = func() time.Time { return time.Date(2023, 9, 25, 10, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	cs, err := NewEcbService(config.CurrencyCfg{Service: config.CUR_ECB, RatesFile: "testdata/eurofxref-hist.csv"})
+	assert.NoError(t, err)
+
+	type testCase struct {
+		name string
+		date time.Time
+		want time.Time
+	}
+
+	tcs := []testCase{
+		{
+			name: "Saturday",
+			date: time.Date(2023, 9, 23, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2023, 9, 22, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Today uses the latest published rates",
+			date: time.Date(2023, 9, 25, 8, 0, 0, 0, time.UTC),
+			want: time.Date(2023, 9, 22, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Unknown date uses the latest published rates",
+			want: time.Date(2023, 9, 22, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range tcs {
+		cpp := NewCurrencyPostProcess([]string{"USD"})
+		cpp.currency = "EUR"
+		cpp.date = tc.date
+		err := cs.GetConversionRate(cpp)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.want, cpp.rates["USD"].Date, tc.name)
+	}
+
+	cpp := NewCurrencyPostProcess([]string{"USD"})
+	cpp.currency = "EUR"
+	cpp.date = time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	err = cs.GetConversionRate(cpp)
+	assert.Error(t, err, "Before the first published rates")
+}
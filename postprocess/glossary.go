@@ -0,0 +1,64 @@
+package postprocess
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"gopkg.in/yaml.v3"
+)
+
+// GlossaryService translates with a fixed list of phrases from a yaml file. For development and tests without a translation API.
+// A value matching a phrase is replaced as a whole, otherwise every known word is replaced and the rest is kept.
+type GlossaryService struct {
+	phrases map[string]string
+}
+
+func NewGlossaryService(cfg config.TranslationCfg) (*GlossaryService, error) {
+	data, err := os.ReadFile(cfg.Glossary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glossary: %w", err)
+	}
+
+	var glossary map[string]string
+	err = yaml.Unmarshal(data, &glossary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse glossary '%s': %w", cfg.Glossary, err)
+	}
+
+	return NewGlossary(glossary), nil
+}
+
+func NewGlossary(glossary map[string]string) *GlossaryService {
+	ts := GlossaryService{phrases: make(map[string]string, len(glossary))}
+	for phrase, translation := range glossary {
+		ts.phrases[strings.ToLower(phrase)] = translation
+	}
+	return &ts
+}
+
+func (ts *GlossaryService) Translate(ctx context.Context, tpp *TranslationPostProcess) error {
+	keys, vals := tpp.batch()
+	texts := make([]string, len(vals))
+	for i, val := range vals {
+		texts[i] = ts.translate(val)
+	}
+	return tpp.setTranslations(keys, texts)
+}
+
+func (ts *GlossaryService) translate(val string) string {
+	if translation, ok := ts.phrases[strings.ToLower(strings.TrimSpace(val))]; ok {
+		return translation
+	}
+
+	words := strings.Fields(val)
+	for i, word := range words {
+		trimmed := strings.Trim(word, ",.;:")
+		if translation, ok := ts.phrases[strings.ToLower(trimmed)]; ok {
+			words[i] = strings.Replace(word, trimmed, translation, 1)
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,75 @@
+package postprocess
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/likeawizard/document-ai-demo/config"
+)
+
+// LibreTranslateService works with LibreTranslate and any self-hosted server implementing its /translate API
+type LibreTranslateService struct {
+	client   *http.Client
+	endpoint string
+	authKey  string
+}
+
+func NewLibreTranslateService(cfg config.TranslationCfg, client *http.Client) *LibreTranslateService {
+	return &LibreTranslateService{
+		client:   client,
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"),
+		authKey:  cfg.AuthKey,
+	}
+}
+
+func (ts *LibreTranslateService) Translate(ctx context.Context, tpp *TranslationPostProcess) error {
+	type request struct {
+		Q      []string `json:"q"`
+		Source string   `json:"source"`
+		Target string   `json:"target"`
+		Format string   `json:"format"`
+		ApiKey string   `json:"api_key,omitempty"`
+	}
+	type response struct {
+		TranslatedText []string `json:"translatedText"`
+		Error          string   `json:"error"`
+	}
+
+	keys, vals := tpp.batch()
+	if len(vals) == 0 {
+		return nil
+	}
+
+	base, _ := tpp.lang.Base()
+	body, err := json.Marshal(request{Q: vals, Source: "auto", Target: base.String(), Format: "text", ApiKey: ts.authKey})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.endpoint+"/translate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to translate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var translated response
+	err = json.NewDecoder(resp.Body).Decode(&translated)
+	if err != nil {
+		return fmt.Errorf("failed to translate: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to translate: %s: %s", resp.Status, translated.Error)
+	}
+
+	return tpp.setTranslations(keys, translated.TranslatedText)
+}
@@ -1,64 +1,162 @@
 package postprocess
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
 	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
 	"github.com/likeawizard/document-ai-demo/store"
 	"github.com/likeawizard/document-ai-demo/transform"
+	"golang.org/x/text/language"
 )
 
 type FieldMap map[string]string
 
 type PostProcessor interface {
-	GetFields(transform.Expense) error
+	GetFields(*transform.Expense) error
 	Apply(*transform.Expense)
 }
 
 type PostProcessService struct {
 	CurrencyService    CurrencyService
 	TranslationService TranslationService
+	Classifier         Classifier
 	FileStore          store.FileStore
+	targetCurrencies   []string
+	tenantCurrencies   map[string][]string
+	targetLanguage     language.Tag
+	translationFields  []string
+	translationTimeout time.Duration
+	// minimum processor confidence of the fields each post-processor uses
+	currencyConfidence    float64
+	translationConfidence float64
 }
 
-func NewPostProcessService(cfg config.Config) (*PostProcessService, error) {
-	pps := PostProcessService{}
+func NewPostProcessService(cfg config.Config, db database.DB, fs store.FileStore) (*PostProcessService, error) {
+	pps := PostProcessService{
+		FileStore:        fs,
+		targetCurrencies: cfg.Currency.Targets,
+		tenantCurrencies: cfg.Currency.Tenants,
 
-	cs, err := NewCurrencyService(cfg.Currency)
+		currencyConfidence:    cfg.Currency.MinConfidence,
+		translationConfidence: cfg.Translation.MinConfidence,
+	}
+	pps.translationTimeout = translationTimeout(cfg.Translation)
+	if len(pps.targetCurrencies) == 0 {
+		pps.targetCurrencies = []string{DEFAULT_TARGET_CURRENCY}
+	}
+
+	cs, err := NewCurrencyService(cfg.Currency, db)
 	if err != nil {
 		return nil, err
 	}
 	pps.CurrencyService = cs
 
-	ts, err := NewTranslationSerivce()
+	ts, err := NewTranslationSerivce(cfg.Translation)
 	if err != nil {
 		return nil, err
 	}
 	pps.TranslationService = ts
 
-	fs, err := store.NewFileStore(cfg.Store)
+	pps.targetLanguage, err = targetLanguage(cfg.Translation.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validFieldPatterns(cfg.Translation.Fields)
+	if err != nil {
+		return nil, err
+	}
+	pps.translationFields = cfg.Translation.Fields
+
+	classifier, err := NewClassifier(cfg.Categories)
 	if err != nil {
 		return nil, err
 	}
-	pps.FileStore = fs
+	pps.Classifier = classifier
 
 	return &pps, nil
 }
 
-func (pps *PostProcessService) GetCurrencyPostProcess(exp transform.Expense) (*CurrencyPostProcess, error) {
-	cpp := CurrencyPostProcess{}
+// Close releases the client of the translation service if it holds one
+func (pps *PostProcessService) Close() error {
+	if c, ok := pps.TranslationService.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// TargetCurrencies are the currencies to convert a receipt into: the ones requested with the upload,
+// otherwise the ones configured for its tenant, otherwise the default ones
+func (pps *PostProcessService) TargetCurrencies(receipt database.Receipt) []string {
+	if len(receipt.Currencies) > 0 {
+		return receipt.Currencies
+	}
+	if targets, ok := pps.tenantCurrencies[receipt.Tenant]; ok && receipt.Tenant != "" {
+		return targets
+	}
+	return pps.targetCurrencies
+}
+
+func (pps *PostProcessService) GetCurrencyPostProcess(receipt database.Receipt, exp *transform.Expense) (*CurrencyPostProcess, error) {
+	cpp := NewCurrencyPostProcess(pps.TargetCurrencies(receipt))
+	cpp.minConfidence = pps.currencyConfidence
 	err := cpp.GetFields(exp)
 	if err != nil {
 		return nil, err
 	}
 
-	return &cpp, nil
+	return cpp, nil
 }
 
-func (pps *PostProcessService) GetTranslationPostProcess(exp transform.Expense) (*TranslationPostProcess, error) {
-	tpp := TranslationPostProcess{}
+func (pps *PostProcessService) GetTranslationPostProcess(exp *transform.Expense) (*TranslationPostProcess, error) {
+	tpp := NewTranslationPostProcess(pps.targetLanguage, pps.translationFields...)
+	tpp.minConfidence = pps.translationConfidence
 	err := tpp.GetFields(exp)
 	if err != nil {
 		return nil, err
 	}
 
-	return &tpp, nil
+	return tpp, nil
+}
+
+// lowConfidence reports whether the processor was less confident in the field than min. Fields without a source are trusted.
+func lowConfidence(exp *transform.Expense, field string, min float64) bool {
+	source, ok := exp.Sources[field]
+	return ok && source.Confidence < min
+}
+
+// LoadExpense reads the transformed expense of a receipt from the file store
+func (pps *PostProcessService) LoadExpense(ctx context.Context, receipt database.Receipt) (*transform.Expense, error) {
+	file, err := pps.FileStore.Get(ctx, receipt.GetExpensePath())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var exp transform.Expense
+	err = json.Unmarshal(data, &exp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &exp, nil
+}
+
+func (pps *PostProcessService) StoreExpense(ctx context.Context, receipt database.Receipt, exp *transform.Expense) error {
+	data, err := json.Marshal(exp)
+	if err != nil {
+		return err
+	}
+
+	return pps.FileStore.Store(ctx, receipt.GetExpensePath(), bytes.NewReader(data))
 }
@@ -0,0 +1,65 @@
+package postprocess
+
+import (
+	"errors"
+	"log"
+
+	"github.com/likeawizard/document-ai-demo/database"
+)
+
+// CachedCurrencyService looks up rates in the database first and only asks the wrapped service for the missing ones.
+// Latest rates change during the day and are never served from the cache.
+type CachedCurrencyService struct {
+	next  CurrencyService
+	store database.RateStore
+}
+
+func NewCachedCurrencyService(next CurrencyService, store database.RateStore) *CachedCurrencyService {
+	return &CachedCurrencyService{next: next, store: store}
+}
+
+func (cs *CachedCurrencyService) GetConversionRate(cpp *CurrencyPostProcess) error {
+	day, latest := resolveRateDate(cpp.date)
+	if latest {
+		return cs.next.GetConversionRate(cpp)
+	}
+
+	rates := make(map[string]database.Rate, len(cpp.targets))
+	missing := make([]string, 0)
+	for _, target := range cpp.targets {
+		rate, err := cs.store.GetRate(day, cpp.currency, target)
+		switch {
+		case err == nil:
+			rates[target] = rate
+		case errors.Is(err, database.ErrRateNotFound):
+			missing = append(missing, target)
+		default:
+			log.Printf("rate cache unavailable: %s", err)
+			missing = append(missing, target)
+		}
+	}
+
+	if len(missing) > 0 {
+		targets := cpp.targets
+		cpp.targets = missing
+		err := cs.next.GetConversionRate(cpp)
+		cpp.targets = targets
+		if err != nil {
+			return err
+		}
+
+		fetched := make([]database.Rate, 0, len(cpp.rates))
+		for target, rate := range cpp.rates {
+			rates[target] = rate
+			fetched = append(fetched, rate)
+		}
+		// saved under the resolved day, the service may fall back to an earlier one it has rates for
+		err = cs.store.SaveRates(day, fetched)
+		if err != nil {
+			log.Printf("failed to cache rates: %s", err)
+		}
+	}
+
+	cpp.rates = rates
+	return nil
+}
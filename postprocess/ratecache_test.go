@@ -0,0 +1,87 @@
+package postprocess
+
+import (
+	"testing"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingCurrencyService struct {
+	calls   int
+	targets [][]string
+}
+
+func (cs *countingCurrencyService) GetConversionRate(cpp *CurrencyPostProcess) error {
+	cs.calls++
+	cs.targets = append(cs.targets, cpp.targets)
+	cpp.rates = make(map[string]database.Rate)
+	for _, target := range cpp.targets {
+		cpp.rates[target] = database.Rate{Date: cpp.date, Base: cpp.currency, Target: target, Value: 2, Provider: "counting"}
+	}
+	return nil
+}
+
+func TestCachedCurrencyService(t *testing.T) {
+	next := &countingCurrencyService{}
+	cs := NewCachedCurrencyService(next, database.NewInMemoryDb())
+	date := time.Date(2023, 9, 20, 0, 0, 0, 0, time.UTC)
+
+	cpp := NewCurrencyPostProcess([]string{"EUR"})
+	cpp.currency, cpp.date = "GBP", date
+	err := cs.GetConversionRate(cpp)
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, cpp.rates["EUR"].Value)
+
+	cpp = NewCurrencyPostProcess([]string{"EUR", "USD"})
+	cpp.currency, cpp.date = "GBP", date
+	err = cs.GetConversionRate(cpp)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, next.calls)
+	assert.Equal(t, []string{"USD"}, next.targets[1], "Only the missing rate is requested")
+	assert.Equal(t, []string{"EUR", "USD"}, cpp.targets)
+	assert.Len(t, cpp.rates, 2)
+
+	cpp = NewCurrencyPostProcess([]string{"USD", "EUR"})
+	cpp.currency, cpp.date = "GBP", date.Add(10*time.Hour)
+	err = cs.GetConversionRate(cpp)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, next.calls, "Same day and currency pair is served from the cache")
+}
+
+// fallbackCurrencyService only has rates published on a fixed day like the ECB service when more recent ones are missing
+type fallbackCurrencyService struct {
+	countingCurrencyService
+	published time.Time
+}
+
+func (cs *fallbackCurrencyService) GetConversionRate(cpp *CurrencyPostProcess) error {
+	err := cs.countingCurrencyService.GetConversionRate(cpp)
+	for target, rate := range cpp.rates {
+		rate.Date = cs.published
+		cpp.rates[target] = rate
+	}
+	return err
+}
+
+func TestCachedCurrencyServiceWeekend(t *testing.T) {
+	now = func() time.Time { return time.Date(2023, 9, 25, 10, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+	thursday := time.Date(2023, 9, 21, 0, 0, 0, 0, time.UTC)
+	next := &fallbackCurrencyService{published: thursday}
+	cs := NewCachedCurrencyService(next, database.NewInMemoryDb())
+
+	for _, date := range []time.Time{
+		time.Date(2023, 9, 23, 12, 0, 0, 0, time.UTC),
+		time.Date(2023, 9, 23, 18, 0, 0, 0, time.UTC),
+		time.Date(2023, 9, 24, 9, 0, 0, 0, time.UTC),
+	} {
+		cpp := NewCurrencyPostProcess([]string{"EUR"})
+		cpp.currency, cpp.date = "GBP", date
+		err := cs.GetConversionRate(cpp)
+		assert.NoError(t, err)
+		assert.Equal(t, thursday, cpp.rates["EUR"].Date, "Day the rate was published")
+	}
+	assert.Equal(t, 1, next.calls, "Weekend receipts are served from the cache")
+}
@@ -0,0 +1,61 @@
+package postprocess
+
+import "time"
+
+// now is replaced in tests
+var now = time.Now
+
+// resolveRateDate returns the day whose exchange rate applies to an expense made on date.
+// Rates are published once per business day: an unknown date, today or a future date use the latest rate (latest is true),
+// weekends and TARGET holidays fall back to the previous business day.
+func resolveRateDate(date time.Time) (day time.Time, latest bool) {
+	today := toDay(now())
+	if date.IsZero() || !toDay(date).Before(today) {
+		return today, true
+	}
+
+	day = toDay(date)
+	for !isBusinessDay(day) {
+		day = day.AddDate(0, 0, -1)
+	}
+	return day, false
+}
+
+// toDay drops the time of day keeping the calendar date as printed on the receipt
+func toDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// isBusinessDay is false on weekends and on the TARGET2 holidays no reference rates are published for
+func isBusinessDay(day time.Time) bool {
+	switch day.Weekday() {
+	case time.Saturday, time.Sunday:
+		return false
+	}
+
+	switch {
+	case day.Month() == time.January && day.Day() == 1,
+		day.Month() == time.May && day.Day() == 1,
+		day.Month() == time.December && (day.Day() == 25 || day.Day() == 26):
+		return false
+	}
+
+	easter := easterSunday(day.Year())
+	return !day.Equal(easter.AddDate(0, 0, -2)) && !day.Equal(easter.AddDate(0, 0, 1))
+}
+
+// easterSunday uses the anonymous Gregorian algorithm
+func easterSunday(year int) time.Time {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
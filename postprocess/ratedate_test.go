@@ -0,0 +1,71 @@
+package postprocess
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveRateDate(t *testing.T) {
+	now = func() time.Time { return time.Date(2024, 4, 3, 15, 30, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	type testCase struct {
+		name   string
+		date   time.Time
+		want   time.Time
+		latest bool
+	}
+
+	tcs := []testCase{
+		{
+			name:   "Unknown date",
+			want:   time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC),
+			latest: true,
+		},
+		{
+			name:   "Today",
+			date:   time.Date(2024, 4, 3, 9, 0, 0, 0, time.UTC),
+			want:   time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC),
+			latest: true,
+		},
+		{
+			name:   "Future",
+			date:   time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+			want:   time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC),
+			latest: true,
+		},
+		{
+			name: "Business day",
+			date: time.Date(2024, 3, 27, 18, 45, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 27, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Sunday",
+			date: time.Date(2024, 3, 24, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 22, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Easter Monday back over the weekend and Good Friday",
+			date: time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2024, 3, 28, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Boxing day",
+			date: time.Date(2023, 12, 26, 12, 0, 0, 0, time.UTC),
+			want: time.Date(2023, 12, 22, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "Receipt time zone keeps the printed date",
+			date: time.Date(2024, 3, 28, 23, 30, 0, 0, time.FixedZone("CET", 3600)),
+			want: time.Date(2024, 3, 28, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tc := range tcs {
+		got, latest := resolveRateDate(tc.date)
+		assert.Equal(t, tc.want, got, tc.name)
+		assert.Equal(t, tc.latest, latest, tc.name)
+	}
+}
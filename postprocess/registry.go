@@ -0,0 +1,68 @@
+package postprocess
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/transform"
+)
+
+// Names of the built-in post-processors
+const (
+	PP_CURRENCY    = "currency"
+	PP_TRANSLATION = "translation"
+	PP_CATEGORY    = "category"
+)
+
+// PostProcessorFactory builds a post-processor for a receipt and gathers everything it needs to be applied,
+// e.g. exchange rates or translations. An error skips the post-process for the receipt.
+// The context is the one of the pipeline stage, cancelled on shutdown.
+type PostProcessorFactory func(context.Context, *PostProcessService, database.Receipt, *transform.Expense) (PostProcessor, error)
+
+type Registration struct {
+	Name string
+	// Reads and Writes are the expense field keys the post-processor uses, see transform.FIELD_DATE.
+	// * matches any line item index.
+	Reads  []string
+	Writes []string
+	New    PostProcessorFactory
+	// UpdateReceipt copies expense fields the post-processor wrote to receipt columns, e.g. the category. Optional.
+	UpdateReceipt func(*database.Receipt, *transform.Expense)
+}
+
+var registry = make(map[string]Registration)
+
+// RegisterPostProcessor makes a post-processor available to be enabled by name in the pipeline config
+func RegisterPostProcessor(reg Registration) {
+	if reg.Name == "" || reg.New == nil {
+		panic("post-processor registered without a name or factory")
+	}
+	if _, ok := registry[reg.Name]; ok {
+		panic(fmt.Sprintf("post-processor '%s' registered twice", reg.Name))
+	}
+	registry[reg.Name] = reg
+}
+
+// Lookup returns the post-processor registered under the name
+func Lookup(name string) (Registration, bool) {
+	reg, ok := registry[name]
+	return reg, ok
+}
+
+// Run builds the named post-processor and applies it to the expense. Post-processors that cannot be built are skipped.
+func (pps *PostProcessService) Run(ctx context.Context, name string, receipt database.Receipt, exp *transform.Expense) error {
+	reg, ok := registry[name]
+	if !ok {
+		return fmt.Errorf("unknown post-processor '%s'", name)
+	}
+
+	pp, err := reg.New(ctx, pps, receipt, exp)
+	if err != nil {
+		log.Printf("skipping %s post-process: %s", name, err)
+		return nil
+	}
+	pp.Apply(exp)
+	return nil
+}
@@ -3,50 +3,104 @@ package postprocess
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"time"
 
 	"cloud.google.com/go/translate"
+	"github.com/likeawizard/document-ai-demo/config"
 	"golang.org/x/text/language"
 	"google.golang.org/api/option"
 )
 
+const defaultTranslationTimeout = 10 * time.Second
+
 type TranslationService interface {
-	Translate(*TranslationPostProcess) error
+	Translate(context.Context, *TranslationPostProcess) error
 }
 
-type GoogleTranslationService struct {
-	authFile string
+// NewTranslationSerivce creates the configured translation backend. Clients are created once and shared by all receipts.
+func NewTranslationSerivce(cfg config.TranslationCfg) (TranslationService, error) {
+	timeout := translationTimeout(cfg)
+
+	switch cfg.Service {
+	case config.TR_GOOGLE:
+		return NewGoogleTranslationService(cfg)
+	case config.TR_LIBRETRANSLATE:
+		return NewLibreTranslateService(cfg, &http.Client{Timeout: timeout}), nil
+	case config.TR_DEEPL:
+		return NewDeeplService(cfg, &http.Client{Timeout: timeout}), nil
+	case config.TR_GLOSSARY:
+		return NewGlossaryService(cfg)
+	case config.TR_NOOP:
+		return &NoopTranslationService{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported translation service: '%s'", cfg.Service)
+	}
 }
 
-func NewTranslationSerivce() (TranslationService, error) {
-	// TODO: hardcoded creds
-	return &GoogleTranslationService{authFile: "document-ai-creds.json"}, nil
+// translationTimeout is the configured timeout of a translation, the default if none is set
+func translationTimeout(cfg config.TranslationCfg) time.Duration {
+	if cfg.Timeout <= 0 {
+		return defaultTranslationTimeout
+	}
+	return cfg.Timeout
 }
 
-func (ts *GoogleTranslationService) Translate(tpp *TranslationPostProcess) error {
-	ctx := context.Background()
+type GoogleTranslationService struct {
+	client *translate.Client
+}
 
-	var keys, vals []string
-	for k, v := range tpp.fields {
-		keys = append(keys, k)
-		vals = append(vals, v)
+func NewGoogleTranslationService(cfg config.TranslationCfg) (*GoogleTranslationService, error) {
+	var opts []option.ClientOption
+	if cfg.CredsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredsFile))
 	}
-
-	auth := option.WithCredentialsFile(ts.authFile)
-	client, err := translate.NewClient(ctx, auth)
+	client, err := translate.NewClient(context.Background(), opts...)
 	if err != nil {
-		return fmt.Errorf("failed to translation initialize client: %v", err)
+		return nil, fmt.Errorf("failed to translation initialize client: %v", err)
+	}
+
+	return &GoogleTranslationService{client: client}, nil
+}
+
+func (ts *GoogleTranslationService) Translate(ctx context.Context, tpp *TranslationPostProcess) error {
+	keys, vals := tpp.batch()
+	if len(vals) == 0 {
+		return nil
 	}
-	lang := language.English
-	translation, err := client.Translate(ctx, vals, lang, nil)
+
+	translation, err := ts.client.Translate(ctx, vals, tpp.lang, nil)
 	if err != nil {
 		return fmt.Errorf("failed to translate: %v", err)
 	}
-	translated := make(FieldMap)
 
-	for i := range keys {
-		translated[keys[i]] = translation[i].Text
+	texts := make([]string, len(translation))
+	for i := range translation {
+		texts[i] = translation[i].Text
 	}
-	tpp.translations = translated
+	return tpp.setTranslations(keys, texts)
+}
+
+func (ts *GoogleTranslationService) Close() error {
+	return ts.client.Close()
+}
+
+// NoopTranslationService keeps all values as they are. For development without a translation API.
+type NoopTranslationService struct{}
 
-	return nil
+func (ts *NoopTranslationService) Translate(ctx context.Context, tpp *TranslationPostProcess) error {
+	keys, vals := tpp.batch()
+	return tpp.setTranslations(keys, vals)
+}
+
+// targetLanguage parses the configured target language, English if none is set
+func targetLanguage(lang string) (language.Tag, error) {
+	if lang == "" {
+		return language.English, nil
+	}
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return language.Und, fmt.Errorf("invalid translation target language '%s': %w", lang, err)
+	}
+	return tag, nil
 }
@@ -0,0 +1,170 @@
+package postprocess
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/transform"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/language"
+)
+
+func newTestTranslation() *TranslationPostProcess {
+	tpp := NewTranslationPostProcess(language.English)
+	tpp.fields = FieldMap{
+		transform.FIELD_MERCHANT_NAME:    "Bäckerei Müller",
+		transform.FIELD_MERCHANT_ADDRESS: "Hauptstraße 1, Wien",
+		transform.FIELD_MERCHANT_STRING:  "",
+	}
+	return tpp
+}
+
+var translated = FieldMap{
+	transform.FIELD_MERCHANT_NAME:    "Müller Bakery",
+	transform.FIELD_MERCHANT_ADDRESS: "Main Street 1, Vienna",
+}
+
+func TestLibreTranslateService(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.Equal(t, "/translate", r.URL.Path)
+		var req struct {
+			Q      []string `json:"q"`
+			Target string   `json:"target"`
+			ApiKey string   `json:"api_key"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		assert.Equal(t, "en", req.Target)
+		assert.Equal(t, "secret", req.ApiKey)
+		assert.Equal(t, []string{"Hauptstraße 1, Wien", "Bäckerei Müller"}, req.Q, "Empty fields are not sent")
+		json.NewEncoder(w).Encode(map[string][]string{"translatedText": {"Main Street 1, Vienna", "Müller Bakery"}})
+	}))
+	defer server.Close()
+
+	ts, err := NewTranslationSerivce(config.TranslationCfg{Service: config.TR_LIBRETRANSLATE, Endpoint: server.URL, AuthKey: "secret"})
+	assert.NoError(t, err)
+
+	tpp := newTestTranslation()
+	err = ts.Translate(context.Background(), tpp)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requests, "All fields are translated in a single request")
+	assert.Equal(t, translated, tpp.translations)
+}
+
+func TestDeeplService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/translate", r.URL.Path)
+		assert.Equal(t, "DeepL-Auth-Key secret", r.Header.Get("Authorization"))
+		var req struct {
+			Text       []string `json:"text"`
+			TargetLang string   `json:"target_lang"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		assert.Equal(t, "EN", req.TargetLang)
+		w.Write([]byte(`{"translations": [
+			{"detected_source_language": "DE", "text": "Main Street 1, Vienna"},
+			{"detected_source_language": "DE", "text": "Müller Bakery"}
+		]}`))
+	}))
+	defer server.Close()
+
+	ts, err := NewTranslationSerivce(config.TranslationCfg{Service: config.TR_DEEPL, Endpoint: server.URL, AuthKey: "secret"})
+	assert.NoError(t, err)
+
+	tpp := newTestTranslation()
+	err = ts.Translate(context.Background(), tpp)
+	assert.NoError(t, err)
+	assert.Equal(t, translated, tpp.translations)
+}
+
+func TestGlossaryService(t *testing.T) {
+	ts := NewGlossary(map[string]string{
+		"Bäckerei Müller": "Müller Bakery",
+		"Hauptstraße":     "Main Street",
+		"Wien":            "Vienna",
+	})
+
+	tpp := newTestTranslation()
+	err := ts.Translate(context.Background(), tpp)
+	assert.NoError(t, err)
+	assert.Equal(t, translated, tpp.translations)
+}
+
+func TestTranslationSkipsTargetLanguage(t *testing.T) {
+	exp := &transform.Expense{Language: "en", Merchant: transform.Merchant{MerchantName: "Pret A Manger"}}
+	err := NewTranslationPostProcess(language.English).GetFields(exp)
+	assert.Error(t, err, "Document already in the target language")
+
+	exp.Language = "de"
+	tpp := NewTranslationPostProcess(language.English)
+	err = tpp.GetFields(exp)
+	assert.NoError(t, err)
+
+	err = NewGlossary(map[string]string{"Pret A Manger": "Ready To Eat"}).Translate(context.Background(), tpp)
+	assert.NoError(t, err)
+	tpp.Apply(exp)
+	assert.Equal(t, "Pret A Manger", exp.Merchant.MerchantName, "Original text is kept")
+	assert.Equal(t, &transform.Translation{Language: "en", Fields: FieldMap{transform.FIELD_MERCHANT_NAME: "Ready To Eat"}}, exp.Translation)
+}
+
+func TestTranslationAllowList(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var req struct {
+			Q []string `json:"q"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		assert.Equal(t, []string{"Melange", "Sachertorte", "Café Sacher"}, req.Q)
+		json.NewEncoder(w).Encode(map[string][]string{"translatedText": {"Coffee with milk foam", "Sacher cake", "Café Sacher"}})
+	}))
+	defer server.Close()
+
+	ts, err := NewTranslationSerivce(config.TranslationCfg{Service: config.TR_LIBRETRANSLATE, Endpoint: server.URL})
+	assert.NoError(t, err)
+
+	exp := &transform.Expense{
+		Language:    "de",
+		PaymentType: "Bar",
+		Merchant:    transform.Merchant{MerchantName: "Café Sacher", MerchantAddress: "Philharmonikerstraße 4"},
+		LineItems:   []transform.LineItem{{Description: "Melange"}, {Description: "Sachertorte"}},
+	}
+	tpp := NewTranslationPostProcess(language.English, transform.FIELD_MERCHANT_NAME, "line_items.*.description")
+	err = tpp.GetFields(exp)
+	assert.NoError(t, err)
+	err = ts.Translate(context.Background(), tpp)
+	assert.NoError(t, err)
+	tpp.Apply(exp)
+
+	assert.Equal(t, 1, requests, "All fields of a receipt are translated in a single request")
+	assert.Equal(t, FieldMap{
+		transform.FIELD_MERCHANT_NAME:                      "Café Sacher",
+		transform.ItemField(0, transform.ITEM_DESCRIPTION): "Coffee with milk foam",
+		transform.ItemField(1, transform.ITEM_DESCRIPTION): "Sacher cake",
+	}, FieldMap(exp.Translation.Fields))
+}
+
+func TestTranslationMinConfidence(t *testing.T) {
+	exp := &transform.Expense{
+		Language:  "de",
+		Merchant:  transform.Merchant{MerchantName: "Café Sacher", MerchantAddress: "Philharmonikerstraße 4"},
+		LineItems: []transform.LineItem{{Description: "Melange"}},
+		Sources: map[string]transform.Source{
+			transform.FIELD_MERCHANT_NAME:    {Confidence: 0.95},
+			transform.FIELD_MERCHANT_ADDRESS: {Confidence: 0.4},
+		},
+	}
+	tpp := NewTranslationPostProcess(language.English)
+	tpp.minConfidence = 0.8
+	err := tpp.GetFields(exp)
+	assert.NoError(t, err)
+	assert.Equal(t, FieldMap{
+		transform.FIELD_MERCHANT_NAME:                      "Café Sacher",
+		transform.ItemField(0, transform.ITEM_DESCRIPTION): "Melange",
+	}, tpp.fields, "Low confidence address left out, fields without a source kept")
+}
@@ -1,44 +1,139 @@
 package postprocess
 
 import (
+	"context"
 	"fmt"
+	"path"
+	"sort"
 
+	"github.com/likeawizard/document-ai-demo/database"
 	"github.com/likeawizard/document-ai-demo/transform"
 	"golang.org/x/text/language"
 )
 
 type TranslationPostProcess struct {
-	lang         language.Tag
+	lang language.Tag
+	// allowed field key patterns, all text fields if empty
+	allowed      []string
 	translations FieldMap
 	fields       FieldMap
+	// minConfidence of the processor in a field to translate it
+	minConfidence float64
 }
 
-func (pp *TranslationPostProcess) GetFields(exp transform.Expense) error {
-	// TODO: detect document language from processor / transform stage and only apply translation post process if not english
-	detectLang := "any"
-	if detectLang == "en" {
-		return fmt.Errorf("nothing to translate document langauge: '%s'", detectLang)
+func init() {
+	RegisterPostProcessor(Registration{
+		Name: PP_TRANSLATION,
+		Reads: []string{
+			transform.FIELD_LANGUAGE,
+			transform.FIELD_MERCHANT_STRING,
+			transform.FIELD_MERCHANT_NAME,
+			transform.FIELD_MERCHANT_ADDRESS,
+			transform.FIELD_PAYMENT_TYPE,
+			transform.FIELD_LINE_ITEMS + ".*." + transform.ITEM_DESCRIPTION,
+		},
+		Writes: []string{transform.FIELD_TRANSLATION},
+		New:    newTranslationPostProcessor,
+	})
+}
+
+// newTranslationPostProcessor translates the text fields unless the receipt is already in the target language.
+// The translation is cancelled with the stage or once the configured timeout passed.
+func newTranslationPostProcessor(ctx context.Context, pps *PostProcessService, receipt database.Receipt, exp *transform.Expense) (PostProcessor, error) {
+	tpp, err := pps.GetTranslationPostProcess(exp)
+	if err != nil {
+		return nil, err
 	}
-	pp.lang = language.English
+	ctx, cancel := context.WithTimeout(ctx, pps.translationTimeout)
+	defer cancel()
+	err = pps.TranslationService.Translate(ctx, tpp)
+	if err != nil {
+		return nil, err
+	}
+	return tpp, nil
+}
 
-	pp.fields = FieldMap{
-		"merchantAddr": exp.Merchant.MerchantAddress,
-		"merchant":     exp.Merchant.MerchantName,
-		"merchantStr":  exp.Merchant.StringVal,
+func NewTranslationPostProcess(lang language.Tag, allowed ...string) *TranslationPostProcess {
+	return &TranslationPostProcess{lang: lang, allowed: allowed}
+}
+
+// validFieldPatterns checks the translation allow-list, see path.Match
+func validFieldPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid translation field '%s': %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// GetFields collects the allowed text fields by field key, leaving out the ones the processor was not confident in. Documents already in the target language are skipped,
+// documents of unknown language are translated.
+func (pp *TranslationPostProcess) GetFields(exp *transform.Expense) error {
+	target, _ := pp.lang.Base()
+	if exp.Language == target.String() {
+		return fmt.Errorf("nothing to translate document language: '%s'", exp.Language)
+	}
+
+	pp.fields = make(FieldMap)
+	for k, v := range exp.TextFields() {
+		if pp.isAllowed(k) && !lowConfidence(exp, k, pp.minConfidence) {
+			pp.fields[k] = v
+		}
+	}
+	if len(pp.fields) == 0 {
+		return fmt.Errorf("nothing to translate")
 	}
 
 	return nil
 }
 
+func (pp *TranslationPostProcess) isAllowed(field string) bool {
+	if len(pp.allowed) == 0 {
+		return true
+	}
+	for _, pattern := range pp.allowed {
+		if ok, _ := path.Match(pattern, field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply records the translations next to the original text
 func (pp *TranslationPostProcess) Apply(exp *transform.Expense) {
-	for k, v := range pp.translations {
-		switch k {
-		case "merchantAddr":
-			exp.Merchant.MerchantAddress = v
-		case "merchant":
-			exp.Merchant.MerchantName = v
-		case "merchantStr":
-			exp.Merchant.StringVal = v
+	exp.Translation = &transform.Translation{
+		Language: pp.lang.String(),
+		Fields:   pp.translations,
+	}
+}
+
+// batch returns the non-empty fields to translate in a stable order so all of them can be sent in a single request
+func (pp *TranslationPostProcess) batch() ([]string, []string) {
+	keys := make([]string, 0, len(pp.fields))
+	for k, v := range pp.fields {
+		if v != "" {
+			keys = append(keys, k)
 		}
 	}
+	sort.Strings(keys)
+
+	vals := make([]string, len(keys))
+	for i, k := range keys {
+		vals[i] = pp.fields[k]
+	}
+	return keys, vals
+}
+
+// setTranslations stores the translated texts of a batch
+func (pp *TranslationPostProcess) setTranslations(keys, texts []string) error {
+	if len(keys) != len(texts) {
+		return fmt.Errorf("expected %d translations got %d", len(keys), len(texts))
+	}
+	pp.translations = make(FieldMap, len(keys))
+	for i, k := range keys {
+		pp.translations[k] = texts[i]
+	}
+	return nil
 }
@@ -2,6 +2,7 @@ package processor
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,11 +27,12 @@ const (
 	KEY_HEADER        = "Ocp-Apim-Subscription-Key"
 	RESULT_ID_HEADER  = "Apim-Request-Id"
 	MAX_FETCH_RETRIES = 5
+	REQUEST_TIMEOUT   = 30 * time.Second
 )
 
 func NewDocuIntel(cfg config.DocuIntelCfg) *DocuIntel {
 	return &DocuIntel{
-		client:     &http.Client{},
+		client:     &http.Client{Timeout: REQUEST_TIMEOUT},
 		key:        cfg.Key,
 		endpoint:   cfg.Endpoint,
 		modelId:    cfg.ModelId,
@@ -42,39 +44,48 @@ func (docInt *DocuIntel) Schema() string {
 	return config.SCHEMA_DOC_INT
 }
 
-func (docInt *DocuIntel) Process(receipt database.Receipt, fs store.FileStore) error {
-	req, err := docInt.newProcessRequest(receipt, fs)
+func (docInt *DocuIntel) Process(ctx context.Context, receipt database.Receipt, fs store.FileStore) ([]byte, error) {
+	req, err := docInt.newProcessRequest(ctx, receipt, fs)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	res, err := docInt.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error making request: %v", err)
+		return nil, recoverable(fmt.Errorf("error making request: %v", err))
 	}
+	res.Body.Close()
 	if res.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("status not ok: %v", res.Status)
+		return nil, statusError(res)
 	}
 
 	id := res.Header.Get(RESULT_ID_HEADER)
 	if id == "" {
-		return fmt.Errorf("could not retrieve id from response")
+		return nil, fmt.Errorf("could not retrieve id from response")
 	}
 
-	docInt.fetchResult(id, receipt, fs)
+	return docInt.fetchResult(ctx, id)
+}
 
-	return nil
+// statusError fails on an unexpected response status. Throttling and server errors are recoverable.
+func statusError(res *http.Response) error {
+	err := fmt.Errorf("status not ok: %v", res.Status)
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+		return recoverable(err)
+	}
+	return err
 }
 
 func (docInt *DocuIntel) doRequest(req *http.Request) ([]byte, error) {
 	res, err := docInt.client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error making request: %v", err)
+		return nil, recoverable(fmt.Errorf("error making request: %v", err))
 	}
+	defer res.Body.Close()
 	switch res.StatusCode {
 	case http.StatusOK, http.StatusAccepted:
 	default:
-		return nil, fmt.Errorf("status not ok: %v", res.Status)
+		return nil, statusError(res)
 	}
 
 	b, err := io.ReadAll(res.Body)
@@ -85,14 +96,14 @@ func (docInt *DocuIntel) doRequest(req *http.Request) ([]byte, error) {
 	return b, nil
 }
 
-func (docInt *DocuIntel) newProcessRequest(receipt database.Receipt, fileStore store.FileStore) (*http.Request, error) {
+func (docInt *DocuIntel) newProcessRequest(ctx context.Context, receipt database.Receipt, fileStore store.FileStore) (*http.Request, error) {
 	url := fmt.Sprintf("%s/formrecognizer/documentModels/%s:analyze?api-version=%s", docInt.endpoint, docInt.modelId, docInt.apiVersion)
 
 	type Payload struct {
 		UrlSource string `json:"urlSource"`
 	}
 
-	sourceUrl, err := fileStore.GetURL(receipt.Path)
+	sourceUrl, err := fileStore.GetURL(ctx, receipt.Path)
 	if err != nil {
 		return nil, err
 	}
@@ -104,7 +115,7 @@ func (docInt *DocuIntel) newProcessRequest(receipt database.Receipt, fileStore s
 	}
 	r := bytes.NewReader(data)
 
-	req, err := http.NewRequest(http.MethodPost, url, r)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, r)
 	if err != nil {
 		return nil, err
 	}
@@ -114,9 +125,9 @@ func (docInt *DocuIntel) newProcessRequest(receipt database.Receipt, fileStore s
 	return req, nil
 }
 
-func (docInt *DocuIntel) newResultRequest(resultId string) (*http.Request, error) {
+func (docInt *DocuIntel) newResultRequest(ctx context.Context, resultId string) (*http.Request, error) {
 	url := fmt.Sprintf("%s/formrecognizer/documentModels/%s/analyzeResults/%s?api-version=%s", docInt.endpoint, docInt.modelId, resultId, docInt.apiVersion)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -124,8 +135,8 @@ func (docInt *DocuIntel) newResultRequest(resultId string) (*http.Request, error
 	return req, nil
 }
 
-func (docInt *DocuIntel) analyzeResults(resultId string) ([]byte, error) {
-	req, err := docInt.newResultRequest(resultId)
+func (docInt *DocuIntel) analyzeResults(ctx context.Context, resultId string) ([]byte, error) {
+	req, err := docInt.newResultRequest(ctx, resultId)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %v", err)
 	}
@@ -137,32 +148,33 @@ func (docInt *DocuIntel) analyzeResults(resultId string) ([]byte, error) {
 	return b, nil
 }
 
-func (docInt *DocuIntel) fetchResult(resultId string, receipt database.Receipt, fileStore store.FileStore) error {
+// fetchResult polls the analysis result with a growing delay until it is finished. Stops polling when ctx is cancelled.
+func (docInt *DocuIntel) fetchResult(ctx context.Context, resultId string) ([]byte, error) {
 	retries := MAX_FETCH_RETRIES
-	var b []byte
-	var err error
 	for {
 		if retries == 0 {
-			return errors.New("failed DocInt fetchResult retries exceeded")
+			return nil, recoverable(errors.New("failed DocInt fetchResult retries exceeded"))
 		}
-		b, err = docInt.analyzeResults(resultId)
+		b, err := docInt.analyzeResults(ctx, resultId)
 		if err != nil {
-			return fmt.Errorf("failed DocInt analyzeResults: %w", err)
+			return nil, fmt.Errorf("failed DocInt analyzeResults: %w", err)
 		}
 		jMap := make(map[string]string, 0)
 		json.Unmarshal(b, &jMap) // Ignore error. Only care about status field. Rest can fail.
 
+		if jMap["status"] == "failed" {
+			return nil, errors.New("failed DocInt analyze: document could not be analyzed")
+		}
 		if jMap["status"] == "succeeded" {
-			jsonPath := fmt.Sprintf("%s.json", receipt.Id)
-			err = fileStore.Store(jsonPath, bytes.NewReader(b))
-			if err != nil {
-				return fmt.Errorf("failed DocInt store: %w", err)
-			}
-			break
+			return b, nil
 		}
 		retries--
-		time.Sleep(time.Duration(MAX_FETCH_RETRIES-retries+1) * time.Second)
+		timer := time.NewTimer(time.Duration(MAX_FETCH_RETRIES-retries+1) * time.Second)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
 	}
-
-	return nil
 }
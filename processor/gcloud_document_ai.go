@@ -1,9 +1,9 @@
 package processor
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 
@@ -13,66 +13,80 @@ import (
 	"github.com/likeawizard/document-ai-demo/database"
 	"github.com/likeawizard/document-ai-demo/store"
 	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// GoogleDocumentAI processes receipts with a Document AI processor. The client is shared by all receipts and closed with Close.
 type GoogleDocumentAI struct {
-	credsFile string
-	endpoint  string
-	name      string
+	client *documentai.DocumentProcessorClient
+	name   string
 }
 
-func NewGoogleDocumentAI(cfg config.DocumentAICfg) *GoogleDocumentAI {
-	return &GoogleDocumentAI{
-		credsFile: cfg.CredsFile,
-		endpoint:  fmt.Sprintf("%s-documentai.googleapis.com:443", cfg.Location),
-		name:      fmt.Sprintf("projects/%s/locations/%s/processors/%s", cfg.ProjectId, cfg.Location, cfg.ProcessorId),
+func NewGoogleDocumentAI(cfg config.DocumentAICfg) (*GoogleDocumentAI, error) {
+	opts := []option.ClientOption{option.WithEndpoint(fmt.Sprintf("%s-documentai.googleapis.com:443", cfg.Location))}
+	if cfg.CredsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredsFile))
+	}
+	client, err := documentai.NewDocumentProcessorClient(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Document AI client: %w", err)
 	}
+
+	return &GoogleDocumentAI{
+		client: client,
+		name:   fmt.Sprintf("projects/%s/locations/%s/processors/%s", cfg.ProjectId, cfg.Location, cfg.ProcessorId),
+	}, nil
 }
 
 func (docAI *GoogleDocumentAI) Schema() string {
 	return config.SCHEMA_DOCUMENT_AI
 }
 
-func (docAI *GoogleDocumentAI) Process(receipt database.Receipt, fileStore store.FileStore) error {
-	ctx := context.Background()
-	client, err := docAI.newDocumentProcessorClient(ctx)
-	if err != nil {
-		return err
-	}
+func (docAI *GoogleDocumentAI) Process(ctx context.Context, receipt database.Receipt, fileStore store.FileStore) ([]byte, error) {
 	req, err := docAI.newDocumentProcessorRequest(ctx, receipt, fileStore)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	resp, err := client.ProcessDocument(ctx, req)
+	resp, err := docAI.client.ProcessDocument(ctx, req)
 	if err != nil {
-		return fmt.Errorf("failed GoogleDocumentAI ProcessDocument call: %w", err)
+		code := status.Code(err)
+		err = fmt.Errorf("failed GoogleDocumentAI ProcessDocument call: %w", err)
+		if isRecoverableCode(code) || errors.Is(err, context.DeadlineExceeded) {
+			return nil, recoverable(err)
+		}
+		return nil, err
 	}
 	doc := resp.GetDocument()
 	json, err := json.Marshal(doc)
 	if err != nil {
-		return fmt.Errorf("failed GoogleDocumentAI doc to json marshal: %w", err)
-	}
-	jsonPath := fmt.Sprintf("%s.json", receipt.Id)
-	err = fileStore.Store(jsonPath, bytes.NewReader(json))
-	if err != nil {
-		return fmt.Errorf("failed GoogleDocumentAI file storage: %w", err)
+		return nil, fmt.Errorf("failed GoogleDocumentAI doc to json marshal: %w", err)
 	}
 
-	return nil
+	return json, nil
+}
+
+func isRecoverableCode(code codes.Code) bool {
+	switch code {
+	case codes.DeadlineExceeded, codes.Unavailable, codes.ResourceExhausted, codes.Internal, codes.Aborted:
+		return true
+	default:
+		return false
+	}
 }
 
-func (docAI *GoogleDocumentAI) newDocumentProcessorClient(ctx context.Context) (*documentai.DocumentProcessorClient, error) {
-	auth := option.WithCredentialsFile(docAI.credsFile)
-	endpointOpt := option.WithEndpoint(docAI.endpoint)
-	return documentai.NewDocumentProcessorClient(ctx, endpointOpt, auth)
+// Close releases the Document AI client. The processor must not be used afterwards.
+func (docAI *GoogleDocumentAI) Close() error {
+	return docAI.client.Close()
 }
 
 func (docAI *GoogleDocumentAI) newDocumentProcessorRequest(ctx context.Context, receipt database.Receipt, fileStore store.FileStore) (*documentaipb.ProcessRequest, error) {
-	f, err := fileStore.Get(receipt.Path)
+	f, err := fileStore.Get(ctx, receipt.Path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
 	data, err := io.ReadAll(f)
 	if err != nil {
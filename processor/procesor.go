@@ -1,8 +1,14 @@
 package processor
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
 
 	"github.com/likeawizard/document-ai-demo/config"
 	"github.com/likeawizard/document-ai-demo/database"
@@ -12,36 +18,60 @@ import (
 var Processor DocumentProcessor
 
 type ProcessorServcie struct {
-	Processor DocumentProcessor
+	// Processors in the order they are tried
+	Processors []DocumentProcessor
+	// Consensus runs all processors instead of stopping at the first one that succeeds
+	Consensus bool
 	FileStore store.FileStore
 	Db        database.DB
 }
 
+// DocumentProcessor sends a receipt to a processing service and returns its raw json result
 type DocumentProcessor interface {
-	Process(receipt database.Receipt, fs store.FileStore) error
+	Process(ctx context.Context, receipt database.Receipt, fs store.FileStore) ([]byte, error)
 	Schema() string
 }
 
-func NewProcessorService(cfg config.Config) (*ProcessorServcie, error) {
-	ps := ProcessorServcie{}
+// RecoverableError marks a failure of the processing service rather than of the receipt itself - a timeout, a 5xx response or an exhausted quota.
+// A different processor might still succeed.
+type RecoverableError struct {
+	Err error
+}
 
-	processor, err := NewDocumentProcessor(cfg.Processor)
-	if err != nil {
-		return nil, err
-	}
-	ps.Processor = processor
+func (e *RecoverableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RecoverableError) Unwrap() error {
+	return e.Err
+}
+
+func recoverable(err error) error {
+	return &RecoverableError{Err: err}
+}
+
+func IsRecoverable(err error) bool {
+	var re *RecoverableError
+	return errors.As(err, &re)
+}
 
-	db, err := database.NewDataBase(cfg.Db)
-	if err != nil {
-		return nil, err
+func NewProcessorService(cfg config.Config, db database.DB, fs store.FileStore) (*ProcessorServcie, error) {
+	ps := ProcessorServcie{
+		Consensus: cfg.App.Consensus,
+		Db:        db,
+		FileStore: fs,
 	}
-	ps.Db = db
 
-	store, err := store.NewFileStore(cfg.Store)
-	if err != nil {
-		return nil, err
+	if len(cfg.Processors) == 0 {
+		return nil, errors.New("no document processor configured")
+	}
+	for _, processorCfg := range cfg.Processors {
+		processor, err := NewDocumentProcessor(processorCfg)
+		if err != nil {
+			return nil, err
+		}
+		ps.Processors = append(ps.Processors, processor)
 	}
-	ps.FileStore = store
 
 	return &ps, nil
 }
@@ -54,16 +84,88 @@ func NewDocumentProcessor(cfg config.ProcessorCfg) (DocumentProcessor, error) {
 	case *config.DocuIntelCfg:
 		return NewDocuIntel(*v), nil
 	case *config.DocumentAICfg:
-		return NewGoogleDocumentAI(*v), nil
+		return NewGoogleDocumentAI(*v)
 	default:
 		return nil, fmt.Errorf("unsupported processor driver: %s", v.Driver())
 	}
 }
 
-func (ps *ProcessorServcie) Process(receipt database.Receipt) error {
-	err := ps.Processor.Process(receipt, ps.FileStore)
-	if err != nil {
-		return err
+// Process runs the receipt through the processors, stores the raw results and returns the schemas they were produced with.
+func (ps *ProcessorServcie) Process(ctx context.Context, receipt database.Receipt) (string, error) {
+	if ps.Consensus && len(ps.Processors) > 1 {
+		return ps.processAll(ctx, receipt)
+	}
+	return ps.processFirst(ctx, receipt)
+}
+
+// Close releases the clients of the processors that hold one. Returns the first error but closes all of them.
+func (ps *ProcessorServcie) Close() error {
+	var err error
+	for _, processor := range ps.Processors {
+		if c, ok := processor.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = fmt.Errorf("failed to close processor '%s': %w", processor.Schema(), cerr)
+			}
+		}
+	}
+	return err
+}
+
+// processFirst tries the processors in order until one succeeds. Only recoverable errors move on to the next processor.
+func (ps *ProcessorServcie) processFirst(ctx context.Context, receipt database.Receipt) (string, error) {
+	var err error
+	for _, processor := range ps.Processors {
+		var data []byte
+		data, err = processor.Process(ctx, receipt, ps.FileStore)
+		if err == nil {
+			return processor.Schema(), ps.FileStore.Store(ctx, receipt.GetJsonPath(), bytes.NewReader(data))
+		}
+		if !IsRecoverable(err) {
+			return "", err
+		}
+		log.Printf("processor '%s' failed for %s: %s", processor.Schema(), receipt.Id, err)
+	}
+	return "", fmt.Errorf("all processors failed, last error: %w", err)
+}
+
+// processAll sends the receipt to all processors at once. Every result is stored under its own path and the result
+// of the first processor in the config order that succeeded also under the regular json path.
+func (ps *ProcessorServcie) processAll(ctx context.Context, receipt database.Receipt) (string, error) {
+	results := make([][]byte, len(ps.Processors))
+	errs := make([]error, len(ps.Processors))
+	var wg sync.WaitGroup
+	for i, processor := range ps.Processors {
+		wg.Add(1)
+		go func(i int, processor DocumentProcessor) {
+			defer wg.Done()
+			results[i], errs[i] = processor.Process(ctx, receipt, ps.FileStore)
+		}(i, processor)
+	}
+	wg.Wait()
+
+	schemas := make([]string, 0, len(ps.Processors))
+	var lastErr error
+	for i, processor := range ps.Processors {
+		if errs[i] != nil {
+			log.Printf("processor '%s' failed for %s: %s", processor.Schema(), receipt.Id, errs[i])
+			lastErr = errs[i]
+			continue
+		}
+		if len(schemas) == 0 {
+			err := ps.FileStore.Store(ctx, receipt.GetJsonPath(), bytes.NewReader(results[i]))
+			if err != nil {
+				return "", err
+			}
+		}
+		err := ps.FileStore.Store(ctx, receipt.GetRawPath(processor.Schema()), bytes.NewReader(results[i]))
+		if err != nil {
+			return "", err
+		}
+		schemas = append(schemas, processor.Schema())
+	}
+
+	if len(schemas) == 0 {
+		return "", fmt.Errorf("all processors failed, last error: %w", lastErr)
 	}
-	return nil
+	return strings.Join(schemas, ","), nil
 }
@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+	"github.com/likeawizard/document-ai-demo/store"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeProcessor struct {
+	schema string
+	err    error
+	calls  int
+}
+
+func (fp *fakeProcessor) Process(context.Context, database.Receipt, store.FileStore) ([]byte, error) {
+	fp.calls++
+	return []byte("{}"), fp.err
+}
+
+func (fp *fakeProcessor) Schema() string {
+	return fp.schema
+}
+
+func TestProcessFallback(t *testing.T) {
+	type testCase struct {
+		name       string
+		processors []*fakeProcessor
+		want       string
+		wantCalls  []int
+		shouldFail bool
+	}
+
+	tcs := []testCase{
+		{
+			name:       "First succeeds",
+			processors: []*fakeProcessor{{schema: "a"}, {schema: "b"}},
+			want:       "a",
+			wantCalls:  []int{1, 0},
+		},
+		{
+			name:       "Recoverable error falls back",
+			processors: []*fakeProcessor{{schema: "a", err: recoverable(errors.New("timeout"))}, {schema: "b"}},
+			want:       "b",
+			wantCalls:  []int{1, 1},
+		},
+		{
+			name:       "Unrecoverable error stops",
+			processors: []*fakeProcessor{{schema: "a", err: errors.New("bad document")}, {schema: "b"}},
+			wantCalls:  []int{1, 0},
+			shouldFail: true,
+		},
+		{
+			name:       "All fail",
+			processors: []*fakeProcessor{{schema: "a", err: recoverable(errors.New("timeout"))}, {schema: "b", err: recoverable(errors.New("quota"))}},
+			wantCalls:  []int{1, 1},
+			shouldFail: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		ps := ProcessorServcie{FileStore: store.NewSystemStore(config.StorageCfg{Location: t.TempDir()})}
+		for _, p := range tc.processors {
+			ps.Processors = append(ps.Processors, p)
+		}
+
+		got, err := ps.Process(context.Background(), database.New(uuid.New()))
+		if tc.shouldFail {
+			assert.Error(t, err, tc.name)
+		} else {
+			assert.NoError(t, err, tc.name)
+		}
+		assert.Equal(t, tc.want, got, tc.name)
+		for i, p := range tc.processors {
+			assert.Equal(t, tc.wantCalls[i], p.calls, tc.name)
+		}
+	}
+}
+
+type closingProcessor struct {
+	fakeProcessor
+	closed bool
+	err    error
+}
+
+func (cp *closingProcessor) Close() error {
+	cp.closed = true
+	return cp.err
+}
+
+func TestProcessorServiceClose(t *testing.T) {
+	a := &closingProcessor{fakeProcessor: fakeProcessor{schema: "a"}, err: errors.New("already closed")}
+	b := &closingProcessor{fakeProcessor: fakeProcessor{schema: "b"}}
+	ps := ProcessorServcie{Processors: []DocumentProcessor{a, &fakeProcessor{schema: "c"}, b}}
+
+	err := ps.Close()
+	assert.ErrorContains(t, err, "'a'")
+	assert.True(t, a.closed)
+	assert.True(t, b.closed, "Closes the rest after an error")
+}
+
+func TestDocuIntelFetchResultCancel(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"status": "running"}`))
+	}))
+	defer server.Close()
+
+	docInt := NewDocuIntel(config.DocuIntelCfg{Endpoint: server.URL})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := docInt.fetchResult(ctx, "result-id")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "Stops waiting for the next poll")
+	assert.Equal(t, 1, requests)
+}
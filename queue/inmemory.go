@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type inMemoryEntry struct {
+	msg         Message
+	lockedUntil time.Time
+}
+
+// InMemoryQueue is a non-persistent Queue. Only usable for debugging and in tests.
+type InMemoryQueue struct {
+	mu      sync.Mutex
+	lease   time.Duration
+	nextId  int64
+	entries []*inMemoryEntry
+}
+
+func NewInMemoryQueue(lease time.Duration) *InMemoryQueue {
+	return &InMemoryQueue{lease: lease}
+}
+
+func (q *InMemoryQueue) Publish(msg Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.publish(msg)
+	return nil
+}
+
+func (q *InMemoryQueue) Claim() (Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, e := range q.entries {
+		if e.lockedUntil.After(now) {
+			continue
+		}
+		e.lockedUntil = now.Add(q.lease)
+		e.msg.Attempts++
+		return e.msg, nil
+	}
+	return Message{}, ErrEmpty
+}
+
+func (q *InMemoryQueue) Ack(msg Message, next ...Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, e := range q.entries {
+		if e.msg.Id == msg.Id {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			for _, n := range next {
+				q.publish(n)
+			}
+			return nil
+		}
+	}
+	return errors.New("message not found")
+}
+
+func (q *InMemoryQueue) Len() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries), nil
+}
+
+func (q *InMemoryQueue) publish(msg Message) {
+	for _, e := range q.entries {
+		if e.msg.ReceiptId == msg.ReceiptId {
+			return
+		}
+	}
+	q.nextId++
+	msg.Id = q.nextId
+	msg.Attempts = 0
+	q.entries = append(q.entries, &inMemoryEntry{msg: msg})
+}
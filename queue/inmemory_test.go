@@ -0,0 +1,58 @@
+package queue_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/likeawizard/document-ai-demo/queue"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryQueue(t *testing.T) {
+	q := queue.NewInMemoryQueue(time.Hour)
+	receiptA, receiptB := uuid.New(), uuid.New()
+
+	_, err := q.Claim()
+	assert.ErrorIs(t, err, queue.ErrEmpty, "Empty queue")
+
+	assert.NoError(t, q.Publish(queue.Message{ReceiptId: receiptA, Msg: "new"}))
+	assert.NoError(t, q.Publish(queue.Message{ReceiptId: receiptA, Msg: "processed"}))
+	assert.NoError(t, q.Publish(queue.Message{ReceiptId: receiptB, Msg: "new"}))
+
+	first, err := q.Claim()
+	assert.NoError(t, err)
+	assert.Equal(t, receiptA, first.ReceiptId, "Oldest message first")
+	assert.Equal(t, "new", first.Msg, "Duplicate publish for a receipt is ignored")
+	assert.Equal(t, 1, first.Attempts)
+
+	second, err := q.Claim()
+	assert.NoError(t, err)
+	assert.Equal(t, receiptB, second.ReceiptId, "Leased message is skipped")
+
+	_, err = q.Claim()
+	assert.ErrorIs(t, err, queue.ErrEmpty, "All messages leased")
+
+	assert.NoError(t, q.Ack(first, queue.Message{ReceiptId: receiptA, Msg: "processed"}))
+	assert.Error(t, q.Ack(first), "Ack twice")
+
+	next, err := q.Claim()
+	assert.NoError(t, err)
+	assert.Equal(t, receiptA, next.ReceiptId)
+	assert.Equal(t, "processed", next.Msg, "Follow-up published on ack")
+}
+
+func TestInMemoryQueueLeaseExpiry(t *testing.T) {
+	q := queue.NewInMemoryQueue(10 * time.Millisecond)
+	id := uuid.New()
+	q.Publish(queue.Message{ReceiptId: id, Msg: "new"})
+
+	claimed, err := q.Claim()
+	assert.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	redelivered, err := q.Claim()
+	assert.NoError(t, err, "Message is redelivered after the lease expires")
+	assert.Equal(t, claimed.Id, redelivered.Id)
+	assert.Equal(t, 2, redelivered.Attempts)
+}
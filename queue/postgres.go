@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PostgresQueue struct {
+	db    *pgxpool.Pool
+	lease time.Duration
+}
+
+// NewPostgresQueue keeps the events in the database of the pool, so they are written on the same connections as the receipts
+func NewPostgresQueue(pool *pgxpool.Pool, lease time.Duration) *PostgresQueue {
+	return &PostgresQueue{db: pool, lease: lease}
+}
+
+func (pq *PostgresQueue) Publish(msg Message) error {
+	return publish(pq.db, msg)
+}
+
+// Claim uses SKIP LOCKED so concurrent consumers never pick up the same message.
+// The lease is stored on the row instead of holding the lock for the duration of processing.
+func (pq *PostgresQueue) Claim() (Message, error) {
+	msg := Message{}
+	sql := `UPDATE events SET locked_until = now() + make_interval(secs => $1), attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM events
+			WHERE locked_until <= now()
+			ORDER BY id
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING id, receipt_id, msg, data, attempts`
+	err := pq.db.QueryRow(context.Background(), sql, pq.lease.Seconds()).Scan(&msg.Id, &msg.ReceiptId, &msg.Msg, &msg.Data, &msg.Attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return msg, ErrEmpty
+	}
+	if err != nil {
+		return msg, fmt.Errorf("failed to claim event: %w", err)
+	}
+	return msg, nil
+}
+
+func (pq *PostgresQueue) Ack(msg Message, next ...Message) error {
+	ctx := context.Background()
+	tx, err := pq.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to ack event %d: %w", msg.Id, err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "DELETE FROM events WHERE id = $1", msg.Id)
+	if err != nil {
+		return fmt.Errorf("failed to ack event %d: %w", msg.Id, err)
+	}
+	for _, n := range next {
+		err = publish(tx, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (pq *PostgresQueue) Len() (int, error) {
+	count := 0
+	err := pq.db.QueryRow(context.Background(), "SELECT count(*) FROM events").Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count events: %w", err)
+	}
+	return count, nil
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+func publish(db execer, msg Message) error {
+	sql := "INSERT INTO events (receipt_id, msg, data) VALUES($1, $2, $3) ON CONFLICT (receipt_id) DO NOTHING"
+	_, err := db.Exec(context.Background(), sql, msg.ReceiptId, msg.Msg, msg.Data)
+	if err != nil {
+		return fmt.Errorf("failed to publish event '%s' for receipt %s: %w", msg.Msg, msg.ReceiptId, err)
+	}
+	return nil
+}
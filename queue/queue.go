@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/database"
+)
+
+const (
+	DRIVER_POSTGRES  = "postgres"
+	DRIVER_IN_MEMORY = "inmemory"
+)
+
+const (
+	defaultLease = 5 * time.Minute
+)
+
+var ErrEmpty = errors.New("no messages available")
+
+// Message is a single pipeline event for a receipt. At most one message per receipt is queued at a time.
+type Message struct {
+	Id        int64
+	ReceiptId uuid.UUID
+	Msg       string
+	Data      map[string]string
+	Attempts  int
+}
+
+// Queue is a durable at-least-once message queue.
+// A claimed message is hidden from other consumers for the lease duration and is delivered again if it is not acknowledged in time.
+type Queue interface {
+	// Publish adds a message. It is a no-op if a message for the same receipt is already queued.
+	Publish(Message) error
+	// Claim leases the oldest available message. Returns ErrEmpty if there is none.
+	Claim() (Message, error)
+	// Ack removes a claimed message and publishes its follow-up messages in one step.
+	Ack(Message, ...Message) error
+	// Len returns the number of queued messages including the claimed ones.
+	Len() (int, error)
+}
+
+// NewQueue builds the configured queue. The postgres queue shares the connection pool of the postgres database.
+func NewQueue(cfg config.QueueCfg, db database.DB) (Queue, error) {
+	lease := cfg.Lease
+	if lease <= 0 {
+		lease = defaultLease
+	}
+
+	switch cfg.Driver {
+	case DRIVER_POSTGRES:
+		pdb, ok := db.(*database.PostgresDb)
+		if !ok {
+			return nil, fmt.Errorf("queue driver %s needs the %s database driver", DRIVER_POSTGRES, database.DRIVER_POSTGRES)
+		}
+		return NewPostgresQueue(pdb.Pool(), lease), nil
+	case DRIVER_IN_MEMORY:
+		return NewInMemoryQueue(lease), nil
+	default:
+		return nil, fmt.Errorf("unsupported queue driver %s", cfg.Driver)
+	}
+}
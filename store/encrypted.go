@@ -0,0 +1,352 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Layout of an encrypted file: magic | master key fingerprint | wrap nonce | wrapped data key | data nonce | ciphertext.
+// Every part has a fixed size so the plaintext size is known without reading the file.
+const (
+	encMagic        = "DAE1"
+	fingerprintSize = 8
+	dataKeySize     = 32
+	nonceSize       = 12
+	tagSize         = 16
+	encHeaderSize   = len(encMagic) + fingerprintSize + nonceSize + dataKeySize + tagSize + nonceSize
+	encOverhead     = encHeaderSize + tagSize
+)
+
+var (
+	ErrUnknownKey = errors.New("file is encrypted with an unknown master key")
+	ErrDecrypt    = errors.New("failed to decrypt file")
+	ErrPlaintext  = errors.New("file is not encrypted")
+)
+
+type masterKey struct {
+	id          string
+	fingerprint []byte
+	aead        cipher.AEAD
+}
+
+// EncryptedStore encrypts files with AES-GCM before handing them to the wrapped store. Each file gets its own data key
+// which is stored with it wrapped by the current master key. The filename is authenticated so files can not be swapped.
+// Files stored before encryption was turned on are rejected unless plaintext is allowed, Rotate encrypts them.
+type EncryptedStore struct {
+	fs      FileStore
+	current *masterKey
+	// keys by fingerprint, the current and the retired ones
+	keys           map[string]*masterKey
+	signer         *URLSigner
+	allowPlaintext bool
+}
+
+func NewEncryptedStore(cfg config.StorageCfg, fs FileStore) (*EncryptedStore, error) {
+	keys, err := loadKeys(cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	es := EncryptedStore{
+		fs:             fs,
+		keys:           make(map[string]*masterKey, len(keys)),
+		signer:         NewURLSigner(cfg),
+		allowPlaintext: cfg.Encryption.AllowPlaintext,
+	}
+	for id, encoded := range keys {
+		key, err := newMasterKey(id, encoded)
+		if err != nil {
+			return nil, err
+		}
+		es.keys[string(key.fingerprint)] = key
+		if id == cfg.Encryption.KeyId {
+			es.current = key
+		}
+	}
+	if es.current == nil {
+		return nil, fmt.Errorf("encryption key '%s' not found", cfg.Encryption.KeyId)
+	}
+	return &es, nil
+}
+
+// loadKeys merges the keys of the config and the key file
+func loadKeys(cfg config.EncryptionCfg) (map[string]string, error) {
+	keys := make(map[string]string, len(cfg.Keys))
+	for id, key := range cfg.Keys {
+		keys[id] = key
+	}
+	if cfg.KeyFile == "" {
+		return keys, nil
+	}
+
+	data, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	var fileKeys map[string]string
+	err = yaml.Unmarshal(data, &fileKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file '%s': %w", cfg.KeyFile, err)
+	}
+	for id, key := range fileKeys {
+		if other, ok := keys[id]; ok && other != key {
+			return nil, fmt.Errorf("encryption key '%s' differs between config and key file", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+func newMasterKey(id, encoded string) (*masterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key '%s' is not base64: %w", id, err)
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("encryption key '%s' must be %d bytes, got %d", id, dataKeySize, len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{id: id, fingerprint: sum[:fingerprintSize], aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (es *EncryptedStore) Get(ctx context.Context, filename string) (io.ReadCloser, error) {
+	data, err := es.read(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncrypted(data) {
+		if !es.allowPlaintext {
+			return nil, fmt.Errorf("%s: %w", filename, ErrPlaintext)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	plain, err := es.decrypt(filename, data)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(plain)), nil
+}
+
+func (es *EncryptedStore) Store(ctx context.Context, filename string, r io.Reader) error {
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	data, err := es.encrypt(filename, plain)
+	if err != nil {
+		return err
+	}
+	return es.fs.Store(ctx, filename, bytes.NewReader(data))
+}
+
+// GetURL returns a URL signed by the app, see URLSigner. URLs of the wrapped store would hand out the encrypted file.
+func (es *EncryptedStore) GetURL(ctx context.Context, filename string) (string, error) {
+	if filename == "" {
+		return "", errors.New("empty filename")
+	}
+	return es.signer.Sign(filename)
+}
+
+func (es *EncryptedStore) Delete(ctx context.Context, filename string) error {
+	return es.fs.Delete(ctx, filename)
+}
+
+// Stat reports the plaintext size. Files not encrypted yet are reported smaller than they are.
+func (es *EncryptedStore) Stat(ctx context.Context, filename string) (FileInfo, error) {
+	info, err := es.fs.Stat(ctx, filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return plainFileInfo(info), nil
+}
+
+func (es *EncryptedStore) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	files, err := es.fs.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		files[i] = plainFileInfo(files[i])
+	}
+	return files, nil
+}
+
+// Close closes the wrapped store
+func (es *EncryptedStore) Close() error {
+	return Close(es.fs)
+}
+
+// Rotate wraps the data keys of all files with the prefix in the current master key and encrypts files stored before
+// encryption was turned on. Only the key header of encrypted files changes. Returns the number of files rewritten.
+// Run it while nothing else writes to the store, retired keys can be removed from the config afterwards.
+func (es *EncryptedStore) Rotate(ctx context.Context, prefix string) (int, error) {
+	files, err := es.fs.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, file := range files {
+		data, err := es.read(ctx, file.Name)
+		if err != nil {
+			return rotated, err
+		}
+
+		var out []byte
+		switch {
+		case !isEncrypted(data):
+			out, err = es.encrypt(file.Name, data)
+		case !bytes.Equal(data[len(encMagic):len(encMagic)+fingerprintSize], es.current.fingerprint):
+			out, err = es.rewrap(data)
+		default:
+			continue
+		}
+		if err != nil {
+			return rotated, fmt.Errorf("failed to rotate '%s': %w", file.Name, err)
+		}
+
+		err = es.fs.Store(ctx, file.Name, bytes.NewReader(out))
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+func (es *EncryptedStore) read(ctx context.Context, filename string) ([]byte, error) {
+	r, err := es.fs.Get(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (es *EncryptedStore) encrypt(filename string, plain []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := es.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, nonce...)
+	return aead.Seal(data, nonce, plain, []byte(filename)), nil
+}
+
+// wrap returns the file header up to the data nonce with the data key wrapped by the current master key
+func (es *EncryptedStore) wrap(dataKey []byte) ([]byte, error) {
+	header := make([]byte, 0, encHeaderSize)
+	header = append(header, encMagic...)
+	header = append(header, es.current.fingerprint...)
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return es.current.aead.Seal(header, nonce, dataKey, header[:len(encMagic)+fingerprintSize]), nil
+}
+
+// unwrap returns the data key of an encrypted file
+func (es *EncryptedStore) unwrap(data []byte) ([]byte, error) {
+	if len(data) < encOverhead {
+		return nil, ErrDecrypt
+	}
+	prefix := data[:len(encMagic)+fingerprintSize]
+	key, ok := es.keys[string(prefix[len(encMagic):])]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	nonce := data[len(prefix) : len(prefix)+nonceSize]
+	wrapped := data[len(prefix)+nonceSize : encHeaderSize-nonceSize]
+	dataKey, err := key.aead.Open(nil, nonce, wrapped, prefix)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return dataKey, nil
+}
+
+func (es *EncryptedStore) decrypt(filename string, data []byte) ([]byte, error) {
+	dataKey, err := es.unwrap(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, data[encHeaderSize-nonceSize:encHeaderSize], data[encHeaderSize:], []byte(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, ErrDecrypt)
+	}
+	return plain, nil
+}
+
+// rewrap replaces the key header of an encrypted file with one wrapped by the current master key
+func (es *EncryptedStore) rewrap(data []byte) ([]byte, error) {
+	dataKey, err := es.unwrap(data)
+	if err != nil {
+		return nil, err
+	}
+	header, err := es.wrap(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, data[encHeaderSize-nonceSize:]...), nil
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encMagic))
+}
+
+// plainFileInfo converts the info of an encrypted file. Sniffed content types are of the ciphertext so it is
+// guessed from the extension.
+func plainFileInfo(info FileInfo) FileInfo {
+	if info.Size >= int64(encOverhead) {
+		info.Size -= int64(encOverhead)
+	}
+	if ct := mime.TypeByExtension(filepath.Ext(info.Name)); ct != "" {
+		info.ContentType = ct
+	}
+	return info
+}
@@ -0,0 +1,163 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func readAll(t *testing.T, fs store.FileStore, name string) (string, error) {
+	r, err := fs.Get(context.Background(), name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(data), nil
+}
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.StorageCfg{
+		Driver:    store.DRIVER_FS,
+		Location:  dir,
+		PublicURL: "http://localhost:8080",
+		Secret:    "verySecret",
+		Encryption: config.EncryptionCfg{
+			KeyId: "2023",
+			Keys:  map[string]string{"2023": testKey(1)},
+		},
+	}
+	fs, err := store.NewFileStore(cfg)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	receipt := "Card **** 4242, Jane Doe"
+	assert.NoError(t, fs.Store(ctx, "receipt.json", strings.NewReader(receipt)))
+	raw, err := os.ReadFile(filepath.Join(dir, "receipt.json"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), "4242", "Encrypted at rest")
+
+	got, err := readAll(t, fs, "receipt.json")
+	assert.NoError(t, err)
+	assert.Equal(t, receipt, got)
+
+	info, err := fs.Stat(ctx, "receipt.json")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(receipt)), info.Size, "Plaintext size")
+	assert.Equal(t, "application/json", info.ContentType)
+
+	// a file copied over another must not decrypt under the wrong name
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "other.json"), raw, 0o644))
+	_, err = readAll(t, fs, "other.json")
+	assert.ErrorIs(t, err, store.ErrDecrypt, "Filename is authenticated")
+	assert.NoError(t, fs.Delete(ctx, "other.json"))
+
+	// files from before encryption was turned on are rejected unless allowed while migrating
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "legacy.json"), []byte("{}"), 0o644))
+	_, err = readAll(t, fs, "legacy.json")
+	assert.ErrorIs(t, err, store.ErrPlaintext, "Plaintext rejected by default")
+	cfg.Encryption.AllowPlaintext = true
+	fs, err = store.NewFileStore(cfg)
+	assert.NoError(t, err)
+	got, err = readAll(t, fs, "legacy.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", got, "Plaintext allowed while migrating")
+
+	signed, err := fs.GetURL(ctx, "receipt.json")
+	assert.NoError(t, err)
+	u, err := url.Parse(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, store.FILES_PATH+"receipt.json", u.Path, "Served decrypted by the app")
+
+	// rotate to a new key, the old one is still needed to read. Plaintext files are encrypted without allowing them.
+	cfg.Encryption = config.EncryptionCfg{KeyId: "2024", Keys: map[string]string{"2023": testKey(1), "2024": testKey(2)}}
+	fs, err = store.NewFileStore(cfg)
+	assert.NoError(t, err)
+	rotated, err := fs.(*store.EncryptedStore).Rotate(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rotated, "Old key and plaintext files")
+	rotated, err = fs.(*store.EncryptedStore).Rotate(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, rotated, "Already rotated")
+
+	cfg.Encryption = config.EncryptionCfg{KeyId: "2024", Keys: map[string]string{"2024": testKey(2)}}
+	fs, err = store.NewFileStore(cfg)
+	assert.NoError(t, err)
+	got, err = readAll(t, fs, "receipt.json")
+	assert.NoError(t, err)
+	assert.Equal(t, receipt, got, "Readable without the retired key")
+	got, err = readAll(t, fs, "legacy.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", got)
+	raw, err = os.ReadFile(filepath.Join(dir, "legacy.json"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, "{}", string(raw), "Plaintext file encrypted by rotation")
+
+	cfg.Encryption = config.EncryptionCfg{KeyId: "2025", Keys: map[string]string{"2025": testKey(3)}}
+	fs, err = store.NewFileStore(cfg)
+	assert.NoError(t, err)
+	_, err = readAll(t, fs, "receipt.json")
+	assert.ErrorIs(t, err, store.ErrUnknownKey)
+}
+
+func TestEncryptedStoreKeys(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys.yml")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("file-key: "+testKey(4)+"\n"), 0o600))
+
+	type testCase struct {
+		name       string
+		cfg        config.EncryptionCfg
+		shouldFail bool
+	}
+
+	tcs := []testCase{
+		{
+			name: "Key from config",
+			cfg:  config.EncryptionCfg{KeyId: "a", Keys: map[string]string{"a": testKey(1)}},
+		},
+		{
+			name: "Key from key file",
+			cfg:  config.EncryptionCfg{KeyId: "file-key", KeyFile: keyFile},
+		},
+		{
+			name:       "Missing current key",
+			cfg:        config.EncryptionCfg{KeyId: "b", Keys: map[string]string{"a": testKey(1)}},
+			shouldFail: true,
+		},
+		{
+			name:       "Short key",
+			cfg:        config.EncryptionCfg{KeyId: "a", Keys: map[string]string{"a": base64.StdEncoding.EncodeToString([]byte("short"))}},
+			shouldFail: true,
+		},
+		{
+			name:       "Key differs from key file",
+			cfg:        config.EncryptionCfg{KeyId: "file-key", Keys: map[string]string{"file-key": testKey(1)}, KeyFile: keyFile},
+			shouldFail: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		_, err := store.NewEncryptedStore(config.StorageCfg{Encryption: tc.cfg}, store.NewSystemStore(config.StorageCfg{Location: t.TempDir()}))
+		if tc.shouldFail {
+			assert.Error(t, err, tc.name)
+		} else {
+			assert.NoError(t, err, tc.name)
+		}
+	}
+}
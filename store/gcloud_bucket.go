@@ -3,67 +3,124 @@ package store
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/likeawizard/document-ai-demo/config"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
+// GCloudBucket stores files in a GCloud storage bucket. The client is shared by all calls and closed with Close.
 type GCloudBucket struct {
-	creds  string
-	bucket string
+	client *storage.Client
+	bucket *storage.BucketHandle
+	urlTTL time.Duration
 }
 
-func NewGCloudStore(cfg config.StorageCfg) *GCloudBucket {
-	// TODO: remove hardcoded credentials
-	return &GCloudBucket{
-		creds:  "document-ai-creds.json",
-		bucket: cfg.Location,
+func NewGCloudStore(cfg config.StorageCfg) (*GCloudBucket, error) {
+	var opts []option.ClientOption
+	if cfg.CredsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(cfg.CredsFile))
 	}
-}
-
-func (gcStore *GCloudBucket) Get(filename string) (io.ReadCloser, error) {
-	ctx := context.Background()
-	bkt, err := gcStore.getBucket(ctx)
+	client, err := storage.NewClient(context.Background(), opts...)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to initialize storage client: %w", err)
 	}
 
-	obj := bkt.Object(filename)
-	return obj.NewReader(ctx)
+	return &GCloudBucket{
+		client: client,
+		bucket: client.Bucket(cfg.Location),
+		urlTTL: cfg.URLTTL,
+	}, nil
 }
 
-func (gcStore *GCloudBucket) Store(filename string, r io.Reader) error {
-	ctx := context.Background()
-	bkt, err := gcStore.getBucket(ctx)
+func (gcStore *GCloudBucket) Get(ctx context.Context, filename string) (io.ReadCloser, error) {
+	r, err := gcStore.bucket.Object(filename).NewReader(ctx)
 	if err != nil {
-		return err
+		return nil, notExist(err)
 	}
+	return r, nil
+}
 
-	obj := bkt.Object(filename)
-	w := obj.NewWriter(ctx)
+// Store aborts the upload by cancelling the context of the writer if copying fails, the object is not created then
+func (gcStore *GCloudBucket) Store(ctx context.Context, filename string, r io.Reader) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := gcStore.bucket.Object(filename).NewWriter(ctx)
 	br := bufio.NewReader(r)
-	_, err = br.WriteTo(w)
+	_, err := br.WriteTo(w)
 	if err != nil {
+		cancel()
+		w.Close()
 		return err
 	}
 
 	return w.Close()
 }
 
-// TODO: this relies on bucket/objects being public. Could generate a temporary SignedURL for more a more robust solution. All files currently are publicly available which is a big no-no for real data.
-func (gcStore *GCloudBucket) GetURL(filename string) (string, error) {
-	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", gcStore.bucket, filename), nil
+// GetURL returns a V4 signed URL so the bucket can stay private. Signed with the service account of the credentials.
+func (gcStore *GCloudBucket) GetURL(ctx context.Context, filename string) (string, error) {
+	ttl := gcStore.urlTTL
+	if ttl <= 0 {
+		ttl = defaultURLTTL
+	}
+	return gcStore.bucket.SignedURL(filename, &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  http.MethodGet,
+		Expires: time.Now().Add(ttl),
+	})
+}
 
+func (gcStore *GCloudBucket) Delete(ctx context.Context, filename string) error {
+	err := gcStore.bucket.Object(filename).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
 }
 
-func (gcStore *GCloudBucket) getBucket(ctx context.Context) (*storage.BucketHandle, error) {
-	auth := option.WithCredentialsFile(gcStore.creds)
-	client, err := storage.NewClient(ctx, auth)
+func (gcStore *GCloudBucket) Stat(ctx context.Context, filename string) (FileInfo, error) {
+	attrs, err := gcStore.bucket.Object(filename).Attrs(ctx)
 	if err != nil {
-		return nil, err
+		return FileInfo{}, notExist(err)
 	}
-	return client.Bucket(gcStore.bucket), nil
+	return gcsFileInfo(attrs), nil
+}
+
+func (gcStore *GCloudBucket) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	files := make([]FileInfo, 0)
+	it := gcStore.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, gcsFileInfo(attrs))
+	}
+	return files, nil
+}
+
+func gcsFileInfo(attrs *storage.ObjectAttrs) FileInfo {
+	return FileInfo{Name: attrs.Name, Size: attrs.Size, ContentType: attrs.ContentType, ModTime: attrs.Updated}
+}
+
+// notExist wraps the missing object error of the bucket in ErrNotExist
+func notExist(err error) error {
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%w: %v", ErrNotExist, err)
+	}
+	return err
+}
+
+// Close releases the storage client. The store must not be used afterwards.
+func (gcStore *GCloudBucket) Close() error {
+	return gcStore.client.Close()
 }
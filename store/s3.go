@@ -0,0 +1,175 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Server-side encryption modes of the s3 store
+const (
+	SSE_S3  = "AES256"
+	SSE_KMS = "aws:kms"
+)
+
+const defaultS3Endpoint = "https://s3.amazonaws.com"
+
+// S3Bucket stores files in an AWS S3 or S3 compatible bucket like MinIO
+type S3Bucket struct {
+	client *minio.Client
+	bucket string
+	sse    encrypt.ServerSide
+	urlTTL time.Duration
+}
+
+func NewS3Store(cfg config.StorageCfg) (*S3Bucket, error) {
+	endpoint := cfg.S3.Endpoint
+	if endpoint == "" {
+		endpoint = defaultS3Endpoint
+	}
+	// endpoints without a scheme are https
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint '%s': %w", cfg.S3.Endpoint, err)
+	}
+
+	// static keys if set, otherwise the usual AWS environment, credentials file and instance role
+	creds := credentials.NewStaticV4(cfg.S3.AccessKey, cfg.S3.SecretKey, "")
+	if cfg.S3.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	lookup := minio.BucketLookupAuto
+	if cfg.S3.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       u.Scheme == "https",
+		Region:       cfg.S3.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s3 := S3Bucket{client: client, bucket: cfg.Location, urlTTL: cfg.URLTTL}
+	if s3.urlTTL <= 0 {
+		s3.urlTTL = defaultURLTTL
+	}
+	switch cfg.S3.SSE {
+	case "":
+	case SSE_S3:
+		s3.sse = encrypt.NewSSE()
+	case SSE_KMS:
+		s3.sse, err = encrypt.NewSSEKMS(cfg.S3.KMSKeyId, nil)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported s3 server-side encryption '%s'", cfg.S3.SSE)
+	}
+
+	return &s3, nil
+}
+
+func (s3 *S3Bucket) Get(ctx context.Context, filename string) (io.ReadCloser, error) {
+	obj, err := s3.client.GetObject(ctx, s3.bucket, filename, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// the object is only requested on first use, fail early if it does not exist
+	_, err = obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, s3NotExist(err)
+	}
+	return obj, nil
+}
+
+// Store uploads the file in a single request. Receipts are small so it is read into memory to know its size,
+// unknown sizes would make the client buffer a whole multipart chunk.
+func (s3 *S3Bucket) Store(ctx context.Context, filename string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.client.PutObject(ctx, s3.bucket, filename, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType:          mime.TypeByExtension(filepath.Ext(filename)),
+		ServerSideEncryption: s3.sse,
+	})
+	return err
+}
+
+// GetURL returns a presigned URL valid for the store url-ttl
+func (s3 *S3Bucket) GetURL(ctx context.Context, filename string) (string, error) {
+	u, err := s3.client.PresignedGetObject(ctx, s3.bucket, filename, s3.urlTTL, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// Delete removes the object. S3 does not report missing objects on delete.
+func (s3 *S3Bucket) Delete(ctx context.Context, filename string) error {
+	return s3.client.RemoveObject(ctx, s3.bucket, filename, minio.RemoveObjectOptions{})
+}
+
+func (s3 *S3Bucket) Stat(ctx context.Context, filename string) (FileInfo, error) {
+	info, err := s3.client.StatObject(ctx, s3.bucket, filename, minio.StatObjectOptions{})
+	if err != nil {
+		return FileInfo{}, s3NotExist(err)
+	}
+	return s3FileInfo(info), nil
+}
+
+func (s3 *S3Bucket) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	// stops the listing goroutine when returning early on an error
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	files := make([]FileInfo, 0)
+	for info := range s3.client.ListObjects(ctx, s3.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		files = append(files, s3FileInfo(info))
+	}
+	return files, nil
+}
+
+// s3FileInfo converts the object info. Listings carry no content type so it is guessed from the extension.
+func s3FileInfo(info minio.ObjectInfo) FileInfo {
+	fi := FileInfo{Name: info.Key, Size: info.Size, ContentType: info.ContentType, ModTime: info.LastModified}
+	if fi.ContentType == "" {
+		fi.ContentType = mime.TypeByExtension(filepath.Ext(info.Key))
+	}
+	return fi
+}
+
+// s3NotExist wraps the missing object error of the bucket in ErrNotExist
+func s3NotExist(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %v", ErrNotExist, err)
+	}
+	return err
+}
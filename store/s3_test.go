@@ -0,0 +1,203 @@
+package store_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/likeawizard/document-ai-demo/store"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is a minimal path-style S3 server keeping objects in memory. It does not check signatures.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	headers map[string]http.Header
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), headers: make(map[string]http.Header)}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := r.URL.Path
+	if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		f.list(w, strings.TrimSuffix(key, "/"), r.URL.Query().Get("prefix"))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readPayload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+		f.headers[key] = r.Header.Clone()
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><Key>%s</Key></Error>`, key)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", f.headers[key].Get("Content-Type"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// list writes a ListObjectsV2 response of the bucket objects with the prefix
+func (f *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	keys := make([]string, 0)
+	for key := range f.objects {
+		name := strings.TrimPrefix(key, bucket+"/")
+		if strings.HasPrefix(key, bucket+"/") && strings.HasPrefix(name, prefix) {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>%s</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>`, strings.TrimPrefix(bucket, "/"), prefix, len(keys))
+	for _, name := range keys {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>"etag"</ETag><Size>%d</Size></Contents>`, name, time.Now().UTC().Format(time.RFC3339), len(f.objects[bucket+"/"+name]))
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+// readPayload decodes the aws-chunked body the client sends over plain http
+func readPayload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	br := bufio.NewReader(r.Body)
+	var body []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return body, nil
+		}
+		chunk := make([]byte, size+2)
+		_, err = io.ReadFull(br, chunk)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	cfg := config.StorageCfg{
+		Driver:   store.DRIVER_S3,
+		Location: "receipts",
+		S3: config.S3Cfg{
+			Endpoint:  srv.URL,
+			Region:    "us-east-1",
+			AccessKey: "minioadmin",
+			SecretKey: "minioadmin",
+			PathStyle: true,
+			SSE:       store.SSE_S3,
+		},
+	}
+	fs, err := store.NewFileStore(cfg)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	err = fs.Store(ctx, "receipt.png", strings.NewReader("receipt"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("receipt"), fake.objects["/receipts/receipt.png"], "Path-style object key")
+	assert.Equal(t, "AES256", fake.headers["/receipts/receipt.png"].Get("X-Amz-Server-Side-Encryption"))
+	assert.Equal(t, "image/png", fake.headers["/receipts/receipt.png"].Get("Content-Type"))
+
+	r, err := fs.Get(ctx, "receipt.png")
+	assert.NoError(t, err)
+	data, err := io.ReadAll(r)
+	r.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "receipt", string(data))
+
+	_, err = fs.Get(ctx, "missing.png")
+	assert.ErrorIs(t, err, store.ErrNotExist, "Missing object")
+
+	info, err := fs.Stat(ctx, "receipt.png")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+	assert.Equal(t, "image/png", info.ContentType)
+
+	err = fs.Store(ctx, "receipt.json", strings.NewReader("{}"))
+	assert.NoError(t, err)
+	files, err := fs.List(ctx, "receipt.")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 2) {
+		assert.Equal(t, "receipt.json", files[0].Name)
+		assert.Equal(t, "application/json", files[0].ContentType, "Guessed from the extension")
+		assert.Equal(t, int64(2), files[0].Size)
+		assert.Equal(t, "receipt.png", files[1].Name)
+	}
+
+	err = fs.Delete(ctx, "receipt.json")
+	assert.NoError(t, err)
+	exists, err := store.Exists(ctx, fs, "receipt.json")
+	assert.NoError(t, err)
+	assert.False(t, exists, "Deleted")
+
+	signed, err := fs.GetURL(ctx, "receipt.png")
+	assert.NoError(t, err)
+	u, err := url.Parse(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, "/receipts/receipt.png", u.Path)
+	assert.Equal(t, "900", u.Query().Get("X-Amz-Expires"), "Default TTL")
+	assert.NotEmpty(t, u.Query().Get("X-Amz-Signature"))
+
+	res, err := http.Get(signed)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	data, _ = io.ReadAll(res.Body)
+	assert.Equal(t, "receipt", string(data), "Presigned URL")
+}
+
+func TestS3StoreConfig(t *testing.T) {
+	_, err := store.NewS3Store(config.StorageCfg{Location: "receipts", S3: config.S3Cfg{SSE: "rot13"}})
+	assert.Error(t, err, "Unsupported encryption")
+
+	_, err = store.NewS3Store(config.StorageCfg{Location: "receipts", S3: config.S3Cfg{SSE: store.SSE_KMS, KMSKeyId: "key"}})
+	assert.NoError(t, err, "KMS")
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
+)
+
+// FILES_PATH is where the app serves the files of stores that have no URLs of their own
+const FILES_PATH = "/files/"
+
+const defaultURLTTL = 15 * time.Minute
+
+var (
+	ErrURLExpired   = errors.New("signed URL expired")
+	ErrURLSignature = errors.New("invalid URL signature")
+)
+
+var now = time.Now
+
+// URLSigner creates time limited download URLs for the files served by the app itself.
+// URLs are signed with an HMAC of the filename and expiry keyed on the app secret.
+type URLSigner struct {
+	secret []byte
+	base   string
+	ttl    time.Duration
+}
+
+func NewURLSigner(cfg config.StorageCfg) *URLSigner {
+	s := URLSigner{
+		secret: []byte(cfg.Secret),
+		base:   strings.TrimSuffix(cfg.PublicURL, "/"),
+		ttl:    cfg.URLTTL,
+	}
+	if s.ttl <= 0 {
+		s.ttl = defaultURLTTL
+	}
+	return &s
+}
+
+// Sign returns the URL the file can be downloaded from until the TTL passes
+func (s *URLSigner) Sign(filename string) (string, error) {
+	if len(s.secret) == 0 || s.base == "" {
+		return "", errors.New("signed URLs need the app secret and store public-url")
+	}
+	expires := strconv.FormatInt(now().Add(s.ttl).Unix(), 10)
+	query := url.Values{
+		"expires":   {expires},
+		"signature": {s.signature(filename, expires)},
+	}
+	return fmt.Sprintf("%s%s%s?%s", s.base, FILES_PATH, url.PathEscape(filename), query.Encode()), nil
+}
+
+// Verify checks the expires and signature query parameters of a signed URL for the file
+func (s *URLSigner) Verify(filename string, query url.Values) error {
+	if len(s.secret) == 0 {
+		return ErrURLSignature
+	}
+	expires := query.Get("expires")
+	want := s.signature(filename, expires)
+	if !hmac.Equal([]byte(want), []byte(query.Get("signature"))) {
+		return ErrURLSignature
+	}
+
+	ts, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrURLSignature
+	}
+	if now().Unix() > ts {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+func (s *URLSigner) signature(filename, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(filename + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
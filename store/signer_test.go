@@ -0,0 +1,41 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestURLSigner(t *testing.T) {
+	defer func() { now = time.Now }()
+	signedAt := time.Date(2023, 9, 20, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return signedAt }
+
+	signer := NewURLSigner(config.StorageCfg{PublicURL: "https://expenses.example.com/", Secret: "verySecret", URLTTL: time.Minute})
+	signed, err := signer.Sign("receipt.png")
+	assert.NoError(t, err)
+
+	u, err := url.Parse(signed)
+	assert.NoError(t, err)
+	assert.Equal(t, "expenses.example.com", u.Host)
+	assert.Equal(t, FILES_PATH+"receipt.png", u.Path)
+	assert.NoError(t, signer.Verify("receipt.png", u.Query()), "Valid")
+
+	assert.ErrorIs(t, signer.Verify("other.png", u.Query()), ErrURLSignature, "Other file")
+
+	tampered := u.Query()
+	tampered.Set("expires", "99999999999")
+	assert.ErrorIs(t, signer.Verify("receipt.png", tampered), ErrURLSignature, "Extended expiry")
+
+	other := NewURLSigner(config.StorageCfg{PublicURL: "https://expenses.example.com", Secret: "otherSecret"})
+	assert.ErrorIs(t, other.Verify("receipt.png", u.Query()), ErrURLSignature, "Other secret")
+
+	now = func() time.Time { return signedAt.Add(2 * time.Minute) }
+	assert.ErrorIs(t, signer.Verify("receipt.png", u.Query()), ErrURLExpired, "Expired")
+
+	_, err = NewURLSigner(config.StorageCfg{PublicURL: "https://expenses.example.com"}).Sign("receipt.png")
+	assert.Error(t, err, "No secret")
+}
@@ -1,8 +1,12 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"time"
 
 	"github.com/likeawizard/document-ai-demo/config"
 )
@@ -10,21 +14,74 @@ import (
 const (
 	DRIVER_FS     = "os"
 	DRIVER_GCLOUD = "gcloud"
+	DRIVER_S3     = "s3"
 )
 
+// ErrNotExist is returned, possibly wrapped, by Get and Stat for missing files
+var ErrNotExist = fs.ErrNotExist
+
 type FileStore interface {
-	Get(string) (io.ReadCloser, error)
-	Store(string, io.Reader) error
-	GetURL(string) (string, error)
+	Get(ctx context.Context, filename string) (io.ReadCloser, error)
+	Store(ctx context.Context, filename string, r io.Reader) error
+	GetURL(ctx context.Context, filename string) (string, error)
+	// Delete removes the file. Deleting a missing file is not an error.
+	Delete(ctx context.Context, filename string) error
+	Stat(ctx context.Context, filename string) (FileInfo, error)
+	// List returns the files whose name starts with the prefix sorted by name
+	List(ctx context.Context, prefix string) ([]FileInfo, error)
+}
+
+type FileInfo struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	ModTime     time.Time `json:"mod_time"`
 }
 
+// NewFileStore creates the store of the driver, wrapped in an EncryptedStore if an encryption key is set
 func NewFileStore(cfg config.StorageCfg) (FileStore, error) {
+	fs, err := newDriverStore(cfg)
+	if err != nil || cfg.Encryption.KeyId == "" {
+		return fs, err
+	}
+	es, err := NewEncryptedStore(cfg, fs)
+	if err != nil {
+		Close(fs)
+		return nil, err
+	}
+	return es, nil
+}
+
+func newDriverStore(cfg config.StorageCfg) (FileStore, error) {
 	switch cfg.Driver {
 	case DRIVER_FS:
 		return NewSystemStore(cfg), nil
 	case DRIVER_GCLOUD:
-		return NewGCloudStore(cfg), nil
+		return NewGCloudStore(cfg)
+	case DRIVER_S3:
+		return NewS3Store(cfg)
 	default:
 		return nil, fmt.Errorf("unsupported file store driver %s", cfg.Driver)
 	}
 }
+
+// Close releases the clients of stores that hold any, like the gcloud store
+func Close(fileStore FileStore) error {
+	if c, ok := fileStore.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Exists reports whether the file is in the store
+func Exists(ctx context.Context, fileStore FileStore, filename string) (bool, error) {
+	_, err := fileStore.Stat(ctx, filename)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrNotExist):
+		return false, nil
+	default:
+		return false, err
+	}
+}
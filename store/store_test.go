@@ -1,6 +1,11 @@
 package store_test
 
 import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/likeawizard/document-ai-demo/config"
@@ -87,3 +92,54 @@ func TestSystemStorePath(t *testing.T) {
 	}
 
 }
+
+func TestSystemStoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "raw"), 0o755))
+	ss := store.NewSystemStore(config.StorageCfg{Location: dir})
+	ctx := context.Background()
+
+	assert.NoError(t, ss.Store(ctx, "receipt.png", strings.NewReader("\x89PNG\r\n\x1a\n")))
+	assert.NoError(t, ss.Store(ctx, "receipt.json", strings.NewReader("{}")))
+	assert.NoError(t, ss.Store(ctx, "raw/receipt", strings.NewReader("%PDF-1.4")))
+
+	info, err := ss.Stat(ctx, "receipt.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "receipt.png", info.Name)
+	assert.Equal(t, int64(8), info.Size)
+	assert.Equal(t, "image/png", info.ContentType)
+	assert.False(t, info.ModTime.IsZero())
+
+	info, err = ss.Stat(ctx, "raw/receipt")
+	assert.NoError(t, err)
+	assert.Equal(t, "application/pdf", info.ContentType, "Sniffed without an extension")
+
+	_, err = ss.Stat(ctx, "raw")
+	assert.ErrorIs(t, err, store.ErrNotExist, "Directories are not files")
+	_, err = ss.Stat(ctx, "missing.png")
+	assert.ErrorIs(t, err, store.ErrNotExist)
+
+	files, err := ss.List(ctx, "")
+	assert.NoError(t, err)
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"raw/receipt", "receipt.json", "receipt.png"}, names)
+
+	files, err = ss.List(ctx, "receipt.")
+	assert.NoError(t, err)
+	assert.Len(t, files, 2, "Prefix")
+
+	assert.NoError(t, ss.Delete(ctx, "receipt.png"))
+	assert.NoError(t, ss.Delete(ctx, "receipt.png"), "Deleting twice")
+	exists, err := store.Exists(ctx, ss, "receipt.png")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	r, err := ss.Get(ctx, "receipt.json")
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "{}", string(data))
+}
@@ -2,16 +2,23 @@ package store
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
+	"io/fs"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/likeawizard/document-ai-demo/config"
 )
 
 type SystemStore struct {
-	base string
+	base   string
+	signer *URLSigner
 }
 
 func (ss *SystemStore) GetPath(filename string) (string, error) {
@@ -22,10 +29,10 @@ func (ss *SystemStore) GetPath(filename string) (string, error) {
 }
 
 func NewSystemStore(cfg config.StorageCfg) *SystemStore {
-	return &SystemStore{base: cfg.Location}
+	return &SystemStore{base: cfg.Location, signer: NewURLSigner(cfg)}
 }
 
-func (ss *SystemStore) Get(filename string) (io.ReadCloser, error) {
+func (ss *SystemStore) Get(ctx context.Context, filename string) (io.ReadCloser, error) {
 	path, err := ss.GetPath(filename)
 	if err != nil {
 		return nil, err
@@ -33,7 +40,7 @@ func (ss *SystemStore) Get(filename string) (io.ReadCloser, error) {
 	return os.Open(path)
 }
 
-func (ss *SystemStore) Store(filename string, r io.Reader) error {
+func (ss *SystemStore) Store(ctx context.Context, filename string, r io.Reader) error {
 	path, err := ss.GetPath(filename)
 	if err != nil {
 		return err
@@ -48,6 +55,91 @@ func (ss *SystemStore) Store(filename string, r io.Reader) error {
 	return err
 }
 
-func (ss *SystemStore) GetURL(filename string) (string, error) {
-	return "", errors.New("OS File store does not support GetURL")
+// GetURL returns a signed URL the file is served on by the app, see URLSigner
+func (ss *SystemStore) GetURL(ctx context.Context, filename string) (string, error) {
+	if filename == "" {
+		return "", errors.New("empty filename")
+	}
+	return ss.signer.Sign(filename)
+}
+
+func (ss *SystemStore) Delete(ctx context.Context, filename string) error {
+	path, err := ss.GetPath(filename)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (ss *SystemStore) Stat(ctx context.Context, filename string) (FileInfo, error) {
+	path, err := ss.GetPath(filename)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if fi.IsDir() {
+		return FileInfo{}, &fs.PathError{Op: "stat", Path: path, Err: ErrNotExist}
+	}
+	return FileInfo{Name: filename, Size: fi.Size(), ContentType: contentType(path), ModTime: fi.ModTime()}, nil
+}
+
+// List walks the store directory. Files in subdirectories are named by their slash separated path relative to it.
+func (ss *SystemStore) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	base := ss.base
+	if base == "" {
+		base = "."
+	}
+	files := make([]FileInfo, 0)
+	err := filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{Name: name, Size: fi.Size(), ContentType: contentType(path), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// contentType guesses the content type from the extension or else the first bytes of the file
+func contentType(path string) string {
+	if ct := mime.TypeByExtension(filepath.Ext(path)); ct != "" {
+		return ct
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return http.DetectContentType(buf[:n])
 }
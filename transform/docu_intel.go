@@ -3,7 +3,11 @@ package transform
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"strings"
 	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
 )
 
 type DocuIntelTransform struct {
@@ -23,21 +27,109 @@ func (dt *DocuIntelTransform) ToCommon() (*Expense, error) {
 		return nil, fmt.Errorf("error parsing DocuIntel data: %s", err)
 	}
 	expense := dt.mapFields(obj.AnalyzeResult.Documents[0].Fields)
+	expense.setLanguage(dt.language(obj.AnalyzeResult), obj.AnalyzeResult.Content)
 
 	return &expense, nil
 }
 
+// language picks the locale covering most of the document text
+func (dt *DocuIntelTransform) language(result AnalyzeResult) Source {
+	length := make(map[string]int)
+	confidence := make(map[string]float64)
+	for _, lang := range result.Languages {
+		locale := baseLanguage(lang.Locale)
+		for _, span := range lang.Spans {
+			length[locale] += span.Length
+			confidence[locale] += lang.Confidence * float64(span.Length)
+		}
+	}
+
+	best := ""
+	for locale := range length {
+		if best == "" || length[locale] > length[best] || (length[locale] == length[best] && locale < best) {
+			best = locale
+		}
+	}
+	if best == "" || length[best] == 0 {
+		return Source{}
+	}
+	return dt.source(confidence[best]/float64(length[best]), best)
+}
+
 func (dt *DocuIntelTransform) mapFields(fields Fields) Expense {
 	exp := Expense{}
 	exp.Currency = fields.Currency.ValueString
+	exp.setSource(FIELD_CURRENCY, dt.source(fields.Currency.Confidence, fields.Currency.Content))
+	// newer model versions only return the currency with the amounts
+	if exp.Currency == "" && fields.Total.ValueCurrency.CurrencyCode != "" {
+		exp.Currency = fields.Total.ValueCurrency.CurrencyCode
+		exp.setSource(FIELD_CURRENCY, dt.source(fields.Total.Confidence, fields.Total.Content))
+	}
 	transTime, err := time.Parse(timeLayout, fmt.Sprintf("%s %s", fields.TransactionDate.ValueDate, fields.TransactionTime.ValueTime))
 	if err == nil {
 		exp.Date = transTime
+		content := strings.TrimSpace(fmt.Sprintf("%s %s", fields.TransactionDate.Content, fields.TransactionTime.Content))
+		exp.setSource(FIELD_DATE, dt.source(fields.TransactionDate.Confidence, content))
 	}
-	exp.Total = fields.Total.ValueNumber
+	exp.Total = MoneyFromFloat(fields.Total.Value(), exp.Currency)
+	exp.setSource(FIELD_TOTAL, dt.source(fields.Total.Confidence, fields.Total.Content))
+	exp.Subtotal = MoneyFromFloat(fields.Subtotal.Value(), exp.Currency)
+	exp.setSource(FIELD_SUBTOTAL, dt.source(fields.Subtotal.Confidence, fields.Subtotal.Content))
+	exp.Tax = MoneyFromFloat(fields.TotalTax.Value(), exp.Currency)
+	exp.setSource(FIELD_TAX, dt.source(fields.TotalTax.Confidence, fields.TotalTax.Content))
 	exp.Merchant.MerchantName = fields.MerchantName.ValueString
+	exp.setSource(FIELD_MERCHANT_NAME, dt.source(fields.MerchantName.Confidence, fields.MerchantName.Content))
 	exp.Merchant.MerchantAddress = fields.MerchantAddress.ValueAddress.String()
+	exp.setSource(FIELD_MERCHANT_ADDRESS, dt.source(fields.MerchantAddress.Confidence, fields.MerchantAddress.Content))
 	exp.Merchant.MerchantPhone = fields.MerchantPhoneNumber.ValuePhoneNumber
+	exp.setSource(FIELD_MERCHANT_PHONE, dt.source(fields.MerchantPhoneNumber.Confidence, fields.MerchantPhoneNumber.Content))
+
+	for i, item := range fields.Items.ValueArray {
+		f := item.ValueObject
+		lineItem := LineItem{
+			Description: f.Description.ValueString,
+			Quantity:    f.Quantity.Value(),
+			TotalPrice:  MoneyFromFloat(f.TotalPrice.Value(), exp.Currency),
+			Confidence:  item.Confidence,
+		}
+		if f.Price.Type != "" {
+			price := PriceFromFloat(f.Price.Value(), exp.Currency)
+			lineItem.UnitPrice = &price
+		}
+		exp.LineItems = append(exp.LineItems, lineItem)
+		exp.setSource(ItemField(i, ITEM_DESCRIPTION), dt.source(f.Description.Confidence, f.Description.Content))
+		exp.setSource(ItemField(i, ITEM_QUANTITY), dt.source(f.Quantity.Confidence, f.Quantity.Content))
+		exp.setSource(ItemField(i, ITEM_UNIT_PRICE), dt.source(f.Price.Confidence, f.Price.Content))
+		exp.setSource(ItemField(i, ITEM_TOTAL_PRICE), dt.source(f.TotalPrice.Confidence, f.TotalPrice.Content))
+	}
+
+	for i, detail := range fields.TaxDetails.ValueArray {
+		f := detail.ValueObject
+		// a rate printed with a percent sign is parsed from the text, only a bare number is taken as a fraction
+		rate := 0.0
+		if f.Rate.Value() != 0 && !strings.Contains(f.Rate.Content, "%") {
+			rate = percent(f.Rate.Value())
+		} else if f.Rate.Content != "" {
+			var err error
+			rate, err = rateParser(f.Rate.Content, "")
+			if err != nil {
+				log.Printf("failed to parse tax rate: %s", err)
+			}
+		}
+		exp.TaxLines = append(exp.TaxLines, TaxLine{
+			Rate:   rate,
+			Base:   MoneyFromFloat(f.NetAmount.Value(), exp.Currency),
+			Amount: MoneyFromFloat(f.Amount.Value(), exp.Currency),
+		})
+		exp.setSource(TaxLineField(i, TAX_RATE), dt.source(f.Rate.Confidence, f.Rate.Content))
+		exp.setSource(TaxLineField(i, TAX_BASE), dt.source(f.NetAmount.Confidence, f.NetAmount.Content))
+		exp.setSource(TaxLineField(i, TAX_AMOUNT), dt.source(f.Amount.Confidence, f.Amount.Content))
+	}
+	exp.sumTaxLines()
 
 	return exp
 }
+
+func (dt *DocuIntelTransform) source(confidence float64, content string) Source {
+	return Source{Confidence: confidence, Content: content, Processor: config.SCHEMA_DOC_INT}
+}
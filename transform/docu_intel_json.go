@@ -16,9 +16,21 @@ type AnalyzeResult struct {
 	APIVersion string     `json:"apiVersion"`
 	ModelID    string     `json:"modelId"`
 	Content    string     `json:"content"`
+	Languages  []Language `json:"languages"`
 	Documents  []Document `json:"documents"`
 }
 
+type Language struct {
+	Spans      []Span  `json:"spans"`
+	Locale     string  `json:"locale"`
+	Confidence float64 `json:"confidence"`
+}
+
+type Span struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
 type Document struct {
 	DocType    string  `json:"docType"`
 	Fields     Fields  `json:"fields"`
@@ -32,8 +44,11 @@ type Fields struct {
 	MerchantPhoneNumber MerchantPhoneNumber `json:"MerchantPhoneNumber,omitempty"`
 	TransactionDate     TransactionDate     `json:"TransactionDate,omitempty"`
 	TransactionTime     TransactionTime     `json:"TransactionTime,omitempty"`
-	Subtotal            Subtotal            `json:"Subtotal,omitempty"`
-	Total               Total               `json:"Total,omitempty"`
+	Subtotal            ItemNumber          `json:"Subtotal,omitempty"`
+	Total               ItemNumber          `json:"Total,omitempty"`
+	TotalTax            ItemNumber          `json:"TotalTax,omitempty"`
+	TaxDetails          TaxDetails          `json:"TaxDetails,omitempty"`
+	Items               Items               `json:"Items,omitempty"`
 }
 
 type Currency struct {
@@ -50,20 +65,6 @@ type MerchantName struct {
 	Confidence  float64 `json:"confidence"`
 }
 
-type Total struct {
-	Type        string  `json:"type"`
-	ValueNumber float64 `json:"valueNumber"`
-	Content     string  `json:"content"`
-	Confidence  float64 `json:"confidence"`
-}
-
-type Subtotal struct {
-	Type        string  `json:"type"`
-	ValueNumber float64 `json:"valueNumber"`
-	Content     string  `json:"content"`
-	Confidence  float64 `json:"confidence"`
-}
-
 type MerchantAddress struct {
 	Type         string       `json:"type"`
 	Content      string       `json:"content"`
@@ -102,6 +103,74 @@ type TransactionTime struct {
 	Confidence float64 `json:"confidence"`
 }
 
+type Items struct {
+	Type       string `json:"type"`
+	ValueArray []Item `json:"valueArray"`
+}
+
+type Item struct {
+	Type        string     `json:"type"`
+	ValueObject ItemFields `json:"valueObject"`
+	Content     string     `json:"content"`
+	Confidence  float64    `json:"confidence"`
+}
+
+type ItemFields struct {
+	Description ItemDescription `json:"Description,omitempty"`
+	Quantity    ItemNumber      `json:"Quantity,omitempty"`
+	Price       ItemNumber      `json:"Price,omitempty"`
+	TotalPrice  ItemNumber      `json:"TotalPrice,omitempty"`
+}
+
+type TaxDetails struct {
+	Type       string      `json:"type"`
+	ValueArray []TaxDetail `json:"valueArray"`
+}
+
+type TaxDetail struct {
+	Type        string           `json:"type"`
+	ValueObject TaxDetailsFields `json:"valueObject"`
+	Content     string           `json:"content"`
+	Confidence  float64          `json:"confidence"`
+}
+
+type TaxDetailsFields struct {
+	Amount    ItemNumber `json:"Amount,omitempty"`
+	NetAmount ItemNumber `json:"NetAmount,omitempty"`
+	// Rate is a fraction like 0.19, older model versions only have the content "19%"
+	Rate ItemNumber `json:"Rate,omitempty"`
+}
+
+type ItemDescription struct {
+	Type        string  `json:"type"`
+	ValueString string  `json:"valueString"`
+	Content     string  `json:"content"`
+	Confidence  float64 `json:"confidence"`
+}
+
+// ItemNumber is either a plain number or a currency amount depending on the model version.
+// Also used for the total, subtotal and tax fields which follow the same rule.
+type ItemNumber struct {
+	Type          string        `json:"type"`
+	ValueNumber   float64       `json:"valueNumber"`
+	ValueCurrency ValueCurrency `json:"valueCurrency"`
+	Content       string        `json:"content"`
+	Confidence    float64       `json:"confidence"`
+}
+
+type ValueCurrency struct {
+	CurrencySymbol string  `json:"currencySymbol"`
+	Amount         float64 `json:"amount"`
+	CurrencyCode   string  `json:"currencyCode"`
+}
+
+func (n ItemNumber) Value() float64 {
+	if n.Type == "currency" {
+		return n.ValueCurrency.Amount
+	}
+	return n.ValueNumber
+}
+
 // TODO: improve address formatting when fields are zero valued
 func (val ValueAddress) String() string {
 	return fmt.Sprintf("%s, %s, %s, %s", val.StreetAddress, val.CityDistrict, val.CountryRegion, val.PostalCode)
@@ -3,7 +3,10 @@ package transform
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"time"
+
+	"github.com/likeawizard/document-ai-demo/config"
 )
 
 const (
@@ -13,6 +16,25 @@ const (
 	supplierAddressType = "supplier_address"
 	totalType           = "total_amount"
 	currecnyType        = "currency"
+	lineItemType        = "line_item"
+	paymentType         = "payment_type"
+	netAmountType       = "net_amount"
+	totalTaxType        = "total_tax_amount"
+	vatType             = "vat"
+)
+
+const (
+	itemDescriptionType = "line_item/description"
+	itemQuantityType    = "line_item/quantity"
+	itemUnitPriceType   = "line_item/unit_price"
+	itemAmountType      = "line_item/amount"
+)
+
+const (
+	vatRateType   = "vat/tax_rate"
+	vatAmountType = "vat/tax_amount"
+	// vatBaseType is the taxable amount of the vat line
+	vatBaseType = "vat/amount"
 )
 
 type DocumentAiTransform struct {
@@ -31,46 +53,213 @@ func (dt *DocumentAiTransform) ToCommon() (*Expense, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing DocumentAi data: %s", err)
 	}
-	expense := dt.mapFields(obj.Entities)
+	expense := Expense{}
+	expense.setLanguage(dt.language(obj.Pages), obj.Text)
+	dt.mapFields(&expense, obj.Entities)
 
 	return &expense, nil
 }
 
-func (dt *DocumentAiTransform) mapFields(entities []Entity) Expense {
-	expense := Expense{}
+// language picks the language detected with the highest confidence over all pages
+func (dt *DocumentAiTransform) language(pages []Page) Source {
+	confidence := make(map[string]float64)
+	for _, page := range pages {
+		for _, lang := range page.DetectedLanguages {
+			confidence[baseLanguage(lang.LanguageCode)] += lang.Confidence
+		}
+	}
+
+	best := ""
+	for code := range confidence {
+		if best == "" || confidence[code] > confidence[best] || (confidence[code] == confidence[best] && code < best) {
+			best = code
+		}
+	}
+	if best == "" {
+		return Source{}
+	}
+	return Source{Confidence: confidence[best] / float64(len(pages)), Content: best, Processor: config.SCHEMA_DOCUMENT_AI}
+}
+
+func (dt *DocumentAiTransform) mapFields(expense *Expense, entities []Entity) {
 	var dateStr, timeStr string
+	var dateSource, timeSource Source
+	hint := dt.moneyHint(entities)
+	hint.Language = expense.Language
 	for _, entity := range entities {
 		switch entity.Type {
 		case dateType:
 			date := entity.NormalizedValue.StructuredValue.DateValue
 			if date.Year != 0 && date.Month != 0 && date.Day != 0 {
 				dateStr = fmt.Sprintf("%d-%02d-%02d", date.Year, date.Month, date.Day)
+				dateSource = dt.source(entity)
 			}
 		case timeType:
 			t := entity.NormalizedValue.StructuredValue.DatetimeValue
 			if t.Hours != 0 && t.Minutes != 0 {
 				timeStr = fmt.Sprintf("%02d:%02d:00", t.Hours, t.Minutes)
+				timeSource = dt.source(entity)
 			}
 		case supplierNameType:
 			expense.Merchant.MerchantName = entity.MentionText
+			expense.setSource(FIELD_MERCHANT_NAME, dt.source(entity))
 		case supplierAddressType:
 			expense.Merchant.MerchantAddress = entity.NormalizedValue.Text
+			expense.setSource(FIELD_MERCHANT_ADDRESS, dt.source(entity))
 		case totalType:
-			expense.Total = moneyParser(entity.MentionText)
+			total, err := moneyParser(entity.MentionText, hint)
+			if err != nil {
+				log.Printf("failed to parse total: %s", err)
+				continue
+			}
+			expense.Total = total
+			expense.setSource(FIELD_TOTAL, dt.source(entity))
+		case netAmountType:
+			subtotal, err := moneyParser(entity.MentionText, hint)
+			if err != nil {
+				log.Printf("failed to parse subtotal: %s", err)
+				continue
+			}
+			expense.Subtotal = subtotal
+			expense.setSource(FIELD_SUBTOTAL, dt.source(entity))
+		case totalTaxType:
+			tax, err := moneyParser(entity.MentionText, hint)
+			if err != nil {
+				log.Printf("failed to parse tax: %s", err)
+				continue
+			}
+			expense.Tax = tax
+			expense.setSource(FIELD_TAX, dt.source(entity))
+		case vatType:
+			dt.mapTaxLine(expense, entity, hint)
 		case currecnyType:
 			expense.Currency = entity.NormalizedValue.Text
+			expense.setSource(FIELD_CURRENCY, dt.source(entity))
+		case paymentType:
+			expense.PaymentType = entity.MentionText
+			expense.setSource(FIELD_PAYMENT_TYPE, dt.source(entity))
+		case lineItemType:
+			dt.mapLineItem(expense, entity, hint)
 		}
 	}
 
+	expense.sumTaxLines()
+
+	// the currency entity is often missing when the code or symbol is part of the total
+	if expense.Currency == "" && expense.Total.Currency != "" {
+		expense.Currency = expense.Total.Currency
+		expense.setSource(FIELD_CURRENCY, expense.Sources[FIELD_TOTAL])
+	}
+
 	if dateStr != "" {
 		if timeStr != "" {
 			dateStr = fmt.Sprintf("%s %s", dateStr, timeStr)
+			dateSource.Content = fmt.Sprintf("%s %s", dateSource.Content, timeSource.Content)
 		}
 		datetime, err := time.Parse(timeLayout, dateStr)
 		if err == nil {
 			expense.Date = datetime
+			expense.setSource(FIELD_DATE, dateSource)
 		}
 	}
+}
+
+func (dt *DocumentAiTransform) mapLineItem(expense *Expense, entity Entity, hint moneyHint) {
+	i := len(expense.LineItems)
+	item := LineItem{Confidence: entity.Confidence}
+	for _, prop := range entity.Properties {
+		var target *Money
+		var field string
+		switch prop.Type {
+		case itemDescriptionType:
+			item.Description = prop.MentionText
+			expense.setSource(ItemField(i, ITEM_DESCRIPTION), dt.propertySource(prop))
+			continue
+		case itemQuantityType:
+			quantity, err := quantityParser(prop.MentionText, hint.Language)
+			if err != nil {
+				log.Printf("failed to parse line item quantity: %s", err)
+				continue
+			}
+			item.Quantity = quantity
+			expense.setSource(ItemField(i, ITEM_QUANTITY), dt.propertySource(prop))
+			continue
+		case itemUnitPriceType:
+			price, err := priceParser(prop.MentionText, hint)
+			if err != nil {
+				log.Printf("failed to parse line item %s: %s", ITEM_UNIT_PRICE, err)
+				continue
+			}
+			item.UnitPrice = &price
+			expense.setSource(ItemField(i, ITEM_UNIT_PRICE), dt.propertySource(prop))
+			continue
+		case itemAmountType:
+			target, field = &item.TotalPrice, ITEM_TOTAL_PRICE
+		default:
+			continue
+		}
+
+		amount, err := moneyParser(prop.MentionText, hint)
+		if err != nil {
+			log.Printf("failed to parse line item %s: %s", field, err)
+			continue
+		}
+		*target = amount
+		expense.setSource(ItemField(i, field), dt.propertySource(prop))
+	}
+	expense.LineItems = append(expense.LineItems, item)
+}
+
+func (dt *DocumentAiTransform) mapTaxLine(expense *Expense, entity Entity, hint moneyHint) {
+	i := len(expense.TaxLines)
+	line := TaxLine{}
+	for _, prop := range entity.Properties {
+		var target *Money
+		var field string
+		switch prop.Type {
+		case vatRateType:
+			rate, err := rateParser(prop.MentionText, hint.Language)
+			if err != nil {
+				log.Printf("failed to parse tax rate: %s", err)
+				continue
+			}
+			line.Rate = rate
+			expense.setSource(TaxLineField(i, TAX_RATE), dt.propertySource(prop))
+			continue
+		case vatBaseType:
+			target, field = &line.Base, TAX_BASE
+		case vatAmountType:
+			target, field = &line.Amount, TAX_AMOUNT
+		default:
+			continue
+		}
+
+		amount, err := moneyParser(prop.MentionText, hint)
+		if err != nil {
+			log.Printf("failed to parse tax line %s: %s", field, err)
+			continue
+		}
+		*target = amount
+		expense.setSource(TaxLineField(i, field), dt.propertySource(prop))
+	}
+	expense.TaxLines = append(expense.TaxLines, line)
+}
+
+// moneyHint uses the currency entity to resolve ambiguous amounts
+func (dt *DocumentAiTransform) moneyHint(entities []Entity) moneyHint {
+	hint := moneyHint{}
+	for _, entity := range entities {
+		if entity.Type == currecnyType {
+			hint.Currency = entity.NormalizedValue.Text
+		}
+	}
+	return hint
+}
+
+func (dt *DocumentAiTransform) propertySource(prop Property) Source {
+	return Source{Confidence: prop.Confidence, Content: prop.MentionText, Processor: config.SCHEMA_DOCUMENT_AI}
+}
 
-	return expense
+func (dt *DocumentAiTransform) source(entity Entity) Source {
+	return Source{Confidence: entity.Confidence, Content: entity.MentionText, Processor: config.SCHEMA_DOCUMENT_AI}
 }
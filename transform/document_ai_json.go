@@ -2,9 +2,20 @@ package transform
 
 type RawDocumentAiData struct {
 	Text     string   `json:"text"`
+	Pages    []Page   `json:"pages"`
 	Entities []Entity `json:"entities"`
 }
 
+type Page struct {
+	PageNumber        int                `json:"page_number"`
+	DetectedLanguages []DetectedLanguage `json:"detected_languages"`
+}
+
+type DetectedLanguage struct {
+	LanguageCode string  `json:"language_code"`
+	Confidence   float64 `json:"confidence"`
+}
+
 type Entity struct {
 	Type            string          `json:"type"`
 	MentionText     string          `json:"mention_text,omitempty"`
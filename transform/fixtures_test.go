@@ -0,0 +1,122 @@
+package transform
+
+import (
+	"os"
+	"testing"
+
+	"github.com/likeawizard/document-ai-demo/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransformFixtures(t *testing.T) {
+	delta := float64(0.005)
+
+	type item struct {
+		description string
+		quantity    float64
+		// unitPrice is empty if the receipt does not print it
+		unitPrice  string
+		totalPrice string
+	}
+
+	type testCase struct {
+		name      string
+		schema    string
+		fixture   string
+		total     string
+		currency  string
+		merchant  string
+		language  string
+		lineItems []item
+		subtotal  string
+		tax       string
+		taxLines  []TaxLine
+		// sources of top-level fields by field key
+		sources map[string]Source
+	}
+
+	tcs := []testCase{
+		{
+			name:     "Azure Document Intelligence",
+			schema:   config.SCHEMA_DOC_INT,
+			fixture:  "testdata/docu_intel_receipt.json",
+			total:    "17.70",
+			currency: "EUR",
+			merchant: "Café Sacher",
+			language: "de",
+			lineItems: []item{
+				{description: "Melange", quantity: 2, unitPrice: "4.90", totalPrice: "9.80"},
+				{description: "Sachertorte", quantity: 1, totalPrice: "7.90"},
+			},
+			subtotal: "16.09",
+			tax:      "1.61",
+			taxLines: []TaxLine{{Rate: 10, Base: Money{Currency: "EUR"}, Amount: Money{Amount: 161, Currency: "EUR"}}},
+			sources: map[string]Source{
+				FIELD_TOTAL: {Confidence: 0.976, Content: "17,70", Processor: config.SCHEMA_DOC_INT},
+				FIELD_DATE:  {Confidence: 0.99, Content: "14.09.2023 10:42", Processor: config.SCHEMA_DOC_INT},
+			},
+		},
+		{
+			name:     "Google Document AI",
+			schema:   config.SCHEMA_DOCUMENT_AI,
+			fixture:  "testdata/document_ai_receipt.json",
+			total:    "8.05",
+			currency: "GBP",
+			merchant: "Pret A Manger",
+			language: "en",
+			lineItems: []item{
+				{description: "Chicken Caesar Wrap", quantity: 1, totalPrice: "5.25"},
+				{description: "Filter Coffee", quantity: 2, unitPrice: "1.40", totalPrice: "2.80"},
+			},
+			subtotal: "6.71",
+			tax:      "1.34",
+			taxLines: []TaxLine{{Rate: 20, Amount: Money{Amount: 134, Currency: "GBP"}}},
+			sources: map[string]Source{
+				FIELD_TOTAL: {Confidence: 0.98, Content: "8.05", Processor: config.SCHEMA_DOCUMENT_AI},
+				FIELD_DATE:  {Confidence: 0.97, Content: "20/09/2023 12:15", Processor: config.SCHEMA_DOCUMENT_AI},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := os.ReadFile(tc.fixture)
+			assert.NoError(t, err)
+
+			dt, err := NewDataTransform(tc.schema, data)
+			assert.NoError(t, err)
+
+			exp, err := dt.ToCommon()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.total, exp.Total.String())
+			assert.Equal(t, tc.currency, exp.Total.Currency)
+			assert.Equal(t, tc.merchant, exp.Merchant.MerchantName)
+			assert.Equal(t, tc.language, exp.Language)
+			assert.Equal(t, tc.schema, exp.Sources[FIELD_LANGUAGE].Processor, "Language reported by the processor")
+			for field, want := range tc.sources {
+				assert.Equal(t, want, exp.Sources[field], field)
+			}
+
+			assert.Len(t, exp.LineItems, len(tc.lineItems))
+			for i, want := range tc.lineItems {
+				got := exp.LineItems[i]
+				assert.Equal(t, want.description, got.Description)
+				assert.InDelta(t, want.quantity, got.Quantity, delta)
+				if want.unitPrice == "" {
+					assert.Nil(t, got.UnitPrice, "Missing unit price")
+				} else if assert.NotNil(t, got.UnitPrice) {
+					assert.Equal(t, want.unitPrice, got.UnitPrice.String())
+				}
+				assert.Equal(t, want.totalPrice, got.TotalPrice.String())
+				assert.Greater(t, got.Confidence, 0.0)
+				assert.Equal(t, tc.schema, exp.Sources[ItemField(i, ITEM_DESCRIPTION)].Processor)
+			}
+
+			assert.Equal(t, tc.subtotal, exp.Subtotal.String())
+			assert.Equal(t, tc.tax, exp.Tax.String())
+			assert.Equal(t, tc.taxLines, exp.TaxLines)
+			exp.checkTax(0)
+			assert.Empty(t, exp.Issues, "Fixture amounts add up")
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package transform
+
+import (
+	"strings"
+	"unicode"
+)
+
+// LANGUAGE_DETECTOR is the Source.Processor of a language detected locally from the document text
+const LANGUAGE_DETECTOR = "detector"
+
+// minLanguageHits is the number of known words needed before the detector makes a guess
+const minLanguageHits = 2
+
+// languageWords are common words and receipt vocabulary that are specific enough to tell the languages apart
+var languageWords = map[string][]string{
+	"en": {"the", "and", "of", "to", "for", "with", "total", "subtotal", "tax", "vat", "change", "cash", "card", "thank", "you", "street", "road", "receipt", "amount", "due", "paid"},
+	"de": {"der", "die", "das", "und", "mit", "für", "summe", "gesamt", "mwst", "ust", "bar", "rückgeld", "danke", "straße", "strasse", "rechnung", "betrag", "zahlung", "kassenbon", "netto", "brutto"},
+	"fr": {"le", "la", "les", "et", "de", "du", "des", "pour", "avec", "tva", "merci", "rue", "montant", "espèces", "rendu", "ticket", "facture", "ttc", "ht"},
+	"es": {"el", "la", "los", "las", "y", "de", "del", "para", "con", "iva", "gracias", "calle", "importe", "efectivo", "cambio", "factura", "ticket"},
+	"it": {"il", "lo", "la", "gli", "e", "di", "per", "con", "totale", "iva", "grazie", "via", "importo", "contanti", "resto", "scontrino", "fattura"},
+	"nl": {"de", "het", "een", "en", "van", "voor", "met", "totaal", "btw", "bedankt", "straat", "bedrag", "contant", "wisselgeld", "bon"},
+	"pt": {"o", "os", "as", "e", "de", "do", "da", "para", "com", "iva", "obrigado", "rua", "valor", "dinheiro", "troco", "fatura", "recibo"},
+}
+
+var languageIndex = func() map[string][]string {
+	index := make(map[string][]string)
+	for lang, words := range languageWords {
+		for _, word := range words {
+			index[word] = append(index[word], lang)
+		}
+	}
+	return index
+}()
+
+// detectLanguage guesses the ISO 639-1 language of a text from the known words it contains.
+// Returns an empty language if there are too few hits to tell.
+func detectLanguage(text string) (string, float64) {
+	scores := make(map[string]float64)
+	total := 0.0
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, word := range words {
+		langs := languageIndex[word]
+		for _, lang := range langs {
+			// words shared by several languages count less
+			scores[lang] += 1 / float64(len(langs))
+		}
+		if len(langs) > 0 {
+			total++
+		}
+	}
+
+	best, bestScore := "", 0.0
+	for lang, score := range scores {
+		if score > bestScore || (score == bestScore && lang < best) {
+			best, bestScore = lang, score
+		}
+	}
+	if total < minLanguageHits {
+		return "", 0
+	}
+	return best, bestScore / total
+}
+
+// detectedLanguage is the Source of a language detected from the text, empty if it could not be detected
+func detectedLanguage(text string) Source {
+	lang, confidence := detectLanguage(text)
+	if lang == "" {
+		return Source{}
+	}
+	return Source{Confidence: confidence, Content: lang, Processor: LANGUAGE_DETECTOR}
+}
+
+// setLanguage sets the document language reported by the processor. Falls back to detecting it from the document text.
+// The language code is kept as the Content of its Source.
+func (exp *Expense) setLanguage(source Source, text string) {
+	if source.Content == "" {
+		source = detectedLanguage(text)
+	}
+	if source.Content == "" {
+		return
+	}
+	exp.Language = source.Content
+	exp.setSource(FIELD_LANGUAGE, source)
+}
+
+// baseLanguage reduces a locale like "de-AT" to its ISO 639-1 language
+func baseLanguage(locale string) string {
+	lang, _, _ := strings.Cut(locale, "-")
+	return strings.ToLower(lang)
+}
@@ -0,0 +1,54 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	type testCase struct {
+		name string
+		text string
+		want string
+	}
+
+	tcs := []testCase{
+		{
+			name: "German",
+			text: "Bäckerei Müller\nHauptstraße 1\n2 Semmel 0,90\nSumme EUR 1,80\nMwSt 10% 0,16\nBar 2,00 Rückgeld 0,20\nDanke!",
+			want: "de",
+		},
+		{
+			name: "English",
+			text: "Pret A Manger\nTotal GBP 8.05\nVAT 20% 1.34\nPaid by card\nThank you for your visit",
+			want: "en",
+		},
+		{
+			name: "Italian",
+			text: "Bar Centrale\nVia Roma 12\nTotale EUR 3,50\nIVA 22%\nContanti 5,00 Resto 1,50\nGrazie",
+			want: "it",
+		},
+		{
+			name: "Too little text",
+			text: "Melange 4,90",
+			want: "",
+		},
+	}
+
+	for _, tc := range tcs {
+		got, _ := detectLanguage(tc.text)
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+}
+
+func TestLanguageFallback(t *testing.T) {
+	dt := NewDocumentAiTransform([]byte(`{"text": "Summe EUR 17,70\nMwSt 10% 1,61\nDanke", "entities": [
+		{"type": "total_amount", "mention_text": "17,70", "confidence": 0.9}
+	]}`))
+	exp, err := dt.ToCommon()
+	assert.NoError(t, err)
+	assert.Equal(t, "de", exp.Language)
+	assert.Equal(t, LANGUAGE_DETECTOR, exp.Sources[FIELD_LANGUAGE].Processor)
+	assert.Equal(t, "17.70", exp.Total.String())
+}
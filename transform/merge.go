@@ -0,0 +1,221 @@
+package transform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field keys used to refer to single expense fields
+const (
+	FIELD_DATE             = "date"
+	FIELD_CURRENCY         = "currency"
+	FIELD_TOTAL            = "total"
+	FIELD_TAX              = "tax"
+	FIELD_SUBTOTAL         = "subtotal"
+	FIELD_TAX_LINES        = "tax_lines"
+	FIELD_MERCHANT_STRING  = "merchant.string_val"
+	FIELD_MERCHANT_NAME    = "merchant.name"
+	FIELD_MERCHANT_REG     = "merchant.reg_no"
+	FIELD_MERCHANT_ADDRESS = "merchant.address"
+	FIELD_MERCHANT_PHONE   = "merchant.phone"
+	FIELD_PAYMENT_TYPE     = "payment_type"
+	FIELD_LANGUAGE         = "language"
+	FIELD_LINE_ITEMS       = "line_items"
+	FIELD_CONVERSIONS      = "conversions"
+	FIELD_TRANSLATION      = "translation"
+	FIELD_CATEGORY         = "category"
+)
+
+// Line item field names. The field key of a single line item field is built with ItemField.
+const (
+	ITEM_DESCRIPTION = "description"
+	ITEM_QUANTITY    = "quantity"
+	ITEM_UNIT_PRICE  = "unit_price"
+	ITEM_TOTAL_PRICE = "total_price"
+)
+
+// ItemField is the field key of a field of the i-th line item, e.g. line_items.0.description
+func ItemField(i int, name string) string {
+	return fmt.Sprintf("%s.%d.%s", FIELD_LINE_ITEMS, i, name)
+}
+
+// Disagreement is a field with different values from different processors. Chosen is the processor whose value was kept.
+type Disagreement struct {
+	Field  string            `json:"field"`
+	Values map[string]string `json:"values"`
+	Chosen string            `json:"chosen"`
+}
+
+type mergeField struct {
+	key string
+	// value formats the field for comparison. Empty means the field was not extracted.
+	value func(*Expense) string
+	copy  func(dst, src *Expense)
+}
+
+var mergeFields = []mergeField{
+	{
+		key: FIELD_DATE,
+		value: func(e *Expense) string {
+			if e.Date.IsZero() {
+				return ""
+			}
+			return e.Date.Format(timeLayout)
+		},
+		copy: func(dst, src *Expense) { dst.Date = src.Date },
+	},
+	{
+		key:   FIELD_CURRENCY,
+		value: func(e *Expense) string { return e.Currency },
+		copy:  func(dst, src *Expense) { dst.Currency = src.Currency },
+	},
+	{
+		key:   FIELD_TOTAL,
+		value: func(e *Expense) string { return formatAmount(e.Total) },
+		copy:  func(dst, src *Expense) { dst.Total = src.Total },
+	},
+	{
+		key:   FIELD_TAX,
+		value: func(e *Expense) string { return formatAmount(e.Tax) },
+		// the tax lines are kept from the same processor so they add up to the tax
+		copy: func(dst, src *Expense) {
+			dst.Tax = src.Tax
+			dst.TaxLines = src.TaxLines
+			prefix := FIELD_TAX_LINES + "."
+			for key, source := range src.Sources {
+				if strings.HasPrefix(key, prefix) {
+					dst.Sources[key] = source
+				}
+			}
+		},
+	},
+	{
+		key:   FIELD_SUBTOTAL,
+		value: func(e *Expense) string { return formatAmount(e.Subtotal) },
+		copy:  func(dst, src *Expense) { dst.Subtotal = src.Subtotal },
+	},
+	{
+		key:   FIELD_MERCHANT_STRING,
+		value: func(e *Expense) string { return e.Merchant.StringVal },
+		copy:  func(dst, src *Expense) { dst.Merchant.StringVal = src.Merchant.StringVal },
+	},
+	{
+		key:   FIELD_MERCHANT_NAME,
+		value: func(e *Expense) string { return e.Merchant.MerchantName },
+		copy:  func(dst, src *Expense) { dst.Merchant.MerchantName = src.Merchant.MerchantName },
+	},
+	{
+		key:   FIELD_MERCHANT_REG,
+		value: func(e *Expense) string { return e.Merchant.MerchantRegistration },
+		copy:  func(dst, src *Expense) { dst.Merchant.MerchantRegistration = src.Merchant.MerchantRegistration },
+	},
+	{
+		key:   FIELD_MERCHANT_ADDRESS,
+		value: func(e *Expense) string { return e.Merchant.MerchantAddress },
+		copy:  func(dst, src *Expense) { dst.Merchant.MerchantAddress = src.Merchant.MerchantAddress },
+	},
+	{
+		key:   FIELD_MERCHANT_PHONE,
+		value: func(e *Expense) string { return e.Merchant.MerchantPhone },
+		copy:  func(dst, src *Expense) { dst.Merchant.MerchantPhone = src.Merchant.MerchantPhone },
+	},
+	{
+		key:   FIELD_PAYMENT_TYPE,
+		value: func(e *Expense) string { return e.PaymentType },
+		copy:  func(dst, src *Expense) { dst.PaymentType = src.PaymentType },
+	},
+	{
+		key:   FIELD_LANGUAGE,
+		value: func(e *Expense) string { return e.Language },
+		copy:  func(dst, src *Expense) { dst.Language = src.Language },
+	},
+}
+
+func formatAmount(m Money) string {
+	if m.IsZero() {
+		return ""
+	}
+	return m.String()
+}
+
+// Merge combines expenses extracted from the same receipt by different processors field by field.
+// For each field the value with the highest confidence wins. Conflicting values are recorded in Review.
+func Merge(expenses []*Expense, schemas []string) *Expense {
+	merged := &Expense{Sources: make(map[string]Source)}
+	for _, field := range mergeFields {
+		values := make(map[string]string)
+		best := -1
+		for i, exp := range expenses {
+			v := field.value(exp)
+			if v == "" {
+				continue
+			}
+			values[schemas[i]] = v
+			if best < 0 || exp.Confidence(field.key) > expenses[best].Confidence(field.key) {
+				best = i
+			}
+		}
+		if best < 0 {
+			continue
+		}
+
+		field.copy(merged, expenses[best])
+		merged.Sources[field.key] = expenses[best].Sources[field.key]
+		if disagree(values) {
+			merged.Review = append(merged.Review, Disagreement{Field: field.key, Values: values, Chosen: schemas[best]})
+		}
+	}
+
+	mergeLineItems(merged, expenses, schemas)
+
+	return merged
+}
+
+// mergeLineItems keeps the line items of the processor with the highest average item confidence as a whole.
+// Items are not matched up between processors, a different item count is recorded for review.
+func mergeLineItems(merged *Expense, expenses []*Expense, schemas []string) {
+	counts := make(map[string]string)
+	best, bestConfidence := -1, 0.0
+	for i, exp := range expenses {
+		if len(exp.LineItems) == 0 {
+			continue
+		}
+		counts[schemas[i]] = strconv.Itoa(len(exp.LineItems))
+		confidence := 0.0
+		for _, item := range exp.LineItems {
+			confidence += item.Confidence
+		}
+		confidence /= float64(len(exp.LineItems))
+		if best < 0 || confidence > bestConfidence {
+			best, bestConfidence = i, confidence
+		}
+	}
+	if best < 0 {
+		return
+	}
+
+	merged.LineItems = expenses[best].LineItems
+	prefix := FIELD_LINE_ITEMS + "."
+	for key, source := range expenses[best].Sources {
+		if strings.HasPrefix(key, prefix) {
+			merged.Sources[key] = source
+		}
+	}
+	if disagree(counts) {
+		merged.Review = append(merged.Review, Disagreement{Field: FIELD_LINE_ITEMS, Values: counts, Chosen: schemas[best]})
+	}
+}
+
+func disagree(values map[string]string) bool {
+	first := ""
+	for _, v := range values {
+		v = strings.ToLower(strings.Join(strings.Fields(v), " "))
+		if first == "" {
+			first = v
+		} else if v != first {
+			return true
+		}
+	}
+	return false
+}
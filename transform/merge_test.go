@@ -0,0 +1,48 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	azure := &Expense{
+		Currency: "EUR",
+		Total:    Money{Amount: 1250, Currency: "EUR"},
+		Merchant: Merchant{MerchantName: "Cafe Central", MerchantPhone: "+43 1 533 37 63"},
+		Sources: map[string]Source{
+			FIELD_CURRENCY:       {Confidence: 0.9, Processor: "docu-intel"},
+			FIELD_TOTAL:          {Confidence: 0.95, Content: "12,50", Processor: "docu-intel"},
+			FIELD_MERCHANT_NAME:  {Confidence: 0.6, Processor: "docu-intel"},
+			FIELD_MERCHANT_PHONE: {Confidence: 0.8, Processor: "docu-intel"},
+		},
+	}
+	google := &Expense{
+		Currency: "EUR",
+		Total:    Money{Amount: 12500, Currency: "EUR"},
+		Merchant: Merchant{MerchantName: "CAFE  CENTRAL", MerchantAddress: "Herrengasse 14, Wien"},
+		Sources: map[string]Source{
+			FIELD_CURRENCY:         {Confidence: 0.99, Processor: "document-ai"},
+			FIELD_TOTAL:            {Confidence: 0.4, Content: "125", Processor: "document-ai"},
+			FIELD_MERCHANT_NAME:    {Confidence: 0.9, Processor: "document-ai"},
+			FIELD_MERCHANT_ADDRESS: {Confidence: 0.7, Processor: "document-ai"},
+		},
+	}
+
+	merged := Merge([]*Expense{azure, google}, []string{"docu-intel", "document-ai"})
+
+	assert.Equal(t, "12.50", merged.Total.String(), "Higher confidence wins")
+	assert.Equal(t, "CAFE  CENTRAL", merged.Merchant.MerchantName, "Higher confidence wins")
+	assert.Equal(t, "+43 1 533 37 63", merged.Merchant.MerchantPhone, "Only one processor extracted the field")
+	assert.Equal(t, "Herrengasse 14, Wien", merged.Merchant.MerchantAddress, "Only one processor extracted the field")
+	assert.Equal(t, 0.99, merged.Confidence(FIELD_CURRENCY))
+	assert.Equal(t, Source{Confidence: 0.95, Content: "12,50", Processor: "docu-intel"}, merged.Sources[FIELD_TOTAL], "Provenance of the chosen value is kept")
+	assert.Equal(t, []Disagreement{
+		{
+			Field:  FIELD_TOTAL,
+			Values: map[string]string{"docu-intel": "12.50", "document-ai": "125.00"},
+			Chosen: "docu-intel",
+		},
+	}, merged.Review, "Only conflicting values need review, case and whitespace are ignored")
+}
@@ -0,0 +1,427 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Money is an exact amount in the minor units of its currency, e.g. cents for EUR or yen for JPY.
+// It is stored as a decimal string in JSON: {"amount": "12.50", "currency": "EUR"}.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+type moneyJSON struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency,omitempty"`
+}
+
+// NewMoney rounds an amount half away from zero to the minor units of the currency
+func NewMoney(amount *big.Rat, currency string) Money {
+	currency = strings.ToUpper(currency)
+	scaled := new(big.Rat).Mul(amount, new(big.Rat).SetInt(minorUnits(currency)))
+
+	num, den := scaled.Num(), scaled.Denom()
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Abs(r).Lsh(r, 1).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(int64(num.Sign())))
+	}
+	return Money{Amount: q.Int64(), Currency: currency}
+}
+
+// ParseMoney parses a plain decimal amount like "-1234.56"
+func ParseMoney(amount, currency string) (Money, error) {
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount '%s'", amount)
+	}
+	return NewMoney(r, currency), nil
+}
+
+// MoneyFromFloat converts amounts processors return as JSON numbers, using their shortest decimal representation
+func MoneyFromFloat(f float64, currency string) Money {
+	m, _ := ParseMoney(strconv.FormatFloat(f, 'f', -1, 64), currency)
+	return m
+}
+
+func minorUnits(currency string) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(CurrencyDecimals(currency))), nil)
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Rat returns the exact amount in major units
+func (m Money) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(m.Amount), minorUnits(m.Currency))
+}
+
+// Convert applies an exchange rate and rounds the result once to the minor units of the target currency
+func (m Money) Convert(rate float64, currency string) Money {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(rate, 'f', -1, 64))
+	if !ok {
+		return Money{Currency: strings.ToUpper(currency)}
+	}
+	return NewMoney(r.Mul(r, m.Rat()), currency)
+}
+
+// String formats the amount with the decimals of its currency: "12.50", "-0.05", "1500"
+func (m Money) String() string {
+	return formatDecimal(m.Amount, CurrencyDecimals(m.Currency))
+}
+
+// formatDecimal formats an amount scaled by 10^decimals
+func formatDecimal(amount int64, decimals int) string {
+	s := strconv.FormatInt(amount, 10)
+	sign := ""
+	if amount < 0 {
+		sign, s = "-", s[1:]
+	}
+	if decimals == 0 {
+		return sign + s
+	}
+	if len(s) <= decimals {
+		s = strings.Repeat("0", decimals-len(s)+1) + s
+	}
+	return sign + s[:len(s)-decimals] + "." + s[len(s)-decimals:]
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.String(), Currency: m.Currency})
+}
+
+// UnmarshalJSON also accepts plain numbers of expenses stored before amounts carried their currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '{' {
+		var n json.Number
+		err := json.Unmarshal(data, &n)
+		if err != nil {
+			return err
+		}
+		*m, err = ParseMoney(n.String(), "")
+		return err
+	}
+
+	var v moneyJSON
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	*m, err = ParseMoney(v.Amount, v.Currency)
+	return err
+}
+
+// Price is an exact unit price. Unlike Money it is not rounded to the minor units of its currency: unit prices like
+// fuel per litre are printed with more decimals, e.g. 1.459 EUR. It keeps the decimals it was parsed with, but at least
+// those of the currency. It is stored like Money in JSON: {"amount": "1.459", "currency": "EUR"}.
+type Price struct {
+	// Amount is the price scaled by 10^Scale
+	Amount   int64
+	Scale    int
+	Currency string
+}
+
+// ParsePrice parses a plain decimal amount like "-1.459" without rounding it
+func ParsePrice(amount, currency string) (Price, error) {
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return Price{}, fmt.Errorf("invalid amount '%s'", amount)
+	}
+	currency = strings.ToUpper(currency)
+	scale := CurrencyDecimals(currency)
+	if i := strings.Index(amount, "."); i >= 0 && len(amount)-i-1 > scale {
+		scale = len(amount) - i - 1
+	}
+
+	scaled := r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)))
+	if !scaled.IsInt() || !scaled.Num().IsInt64() {
+		return Price{}, fmt.Errorf("invalid amount '%s'", amount)
+	}
+	return Price{Amount: scaled.Num().Int64(), Scale: scale, Currency: currency}, nil
+}
+
+// PriceFromFloat converts prices processors return as JSON numbers, using their shortest decimal representation
+func PriceFromFloat(f float64, currency string) Price {
+	p, _ := ParsePrice(strconv.FormatFloat(f, 'f', -1, 64), currency)
+	return p
+}
+
+func (p Price) IsZero() bool {
+	return p.Amount == 0
+}
+
+// Rat returns the exact price in major units
+func (p Price) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(p.Amount), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(p.Scale)), nil))
+}
+
+// String formats the price with all of its decimals but at least those of its currency: "1.459", "4.90", "1500"
+func (p Price) String() string {
+	amount, scale := p.Amount, p.Scale
+	for ; scale < CurrencyDecimals(p.Currency); scale++ {
+		amount *= 10
+	}
+	return formatDecimal(amount, scale)
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: p.String(), Currency: p.Currency})
+}
+
+// UnmarshalJSON also accepts plain numbers of expenses stored before amounts carried their currency
+func (p *Price) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] != '{' {
+		var n json.Number
+		err := json.Unmarshal(data, &n)
+		if err != nil {
+			return err
+		}
+		*p, err = ParsePrice(n.String(), "")
+		return err
+	}
+
+	var v moneyJSON
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		return err
+	}
+	*p, err = ParsePrice(v.Amount, v.Currency)
+	return err
+}
+
+// moneyHint narrows down ambiguous amounts like "1.234" using what else is known about the document
+type moneyHint struct {
+	// Language is the ISO 639-1 code of the document language, it decides the decimal separator
+	Language string
+	// Currency is the ISO 4217 code of the document currency, it decides the number of decimals
+	Currency string
+}
+
+var currencySymbols = map[string]string{
+	"€":   "EUR",
+	"£":   "GBP",
+	"¥":   "JPY",
+	"₩":   "KRW",
+	"₹":   "INR",
+	"₽":   "RUB",
+	"₺":   "TRY",
+	"zł":  "PLN",
+	"kč":  "CZK",
+	"fr.": "CHF",
+	"us$": "USD",
+	"$":   "USD",
+}
+
+// currencyDecimals lists the currencies that do not use 2 decimal places
+var currencyDecimals = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"VND": 0,
+	"CLP": 0,
+	"ISK": 0,
+	"HUF": 0,
+	"BHD": 3,
+	"KWD": 3,
+	"OMR": 3,
+	"JOD": 3,
+	"TND": 3,
+}
+
+// commaDecimalLanguages use a comma as decimal separator
+var commaDecimalLanguages = map[string]bool{
+	"de": true, "fr": true, "es": true, "it": true, "pt": true, "nl": true,
+	"ru": true, "uk": true, "pl": true, "cs": true, "sk": true, "sl": true,
+	"hr": true, "sr": true, "bg": true, "ro": true, "hu": true, "el": true,
+	"tr": true, "sv": true, "da": true, "nb": true, "no": true, "fi": true,
+	"et": true, "lv": true, "lt": true, "id": true, "vi": true,
+}
+
+// CurrencyDecimals returns the number of minor unit digits of an ISO 4217 currency
+func CurrencyDecimals(currency string) int {
+	if d, ok := currencyDecimals[strings.ToUpper(currency)]; ok {
+		return d
+	}
+	return 2
+}
+
+// moneyParser parses an amount as printed on a receipt: "12,34", "1.234,56 €", "USD 1,234.56", "(5.00)", "¥1,500".
+// The currency is the one found in the string, otherwise the hinted one.
+func moneyParser(s string, hint moneyHint) (Money, error) {
+	num, currency, err := parseAmount(s, hint)
+	if err != nil {
+		return Money{}, err
+	}
+	return ParseMoney(num, currency)
+}
+
+// priceParser parses a unit price like moneyParser but keeps all of its decimals
+func priceParser(s string, hint moneyHint) (Price, error) {
+	num, currency, err := parseAmount(s, hint)
+	if err != nil {
+		return Price{}, err
+	}
+	return ParsePrice(num, currency)
+}
+
+// quantityParser parses a line item quantity, which is not bound to the decimals of any currency
+func quantityParser(s string, language string) (float64, error) {
+	num, _, err := parseAmount(s, moneyHint{Language: language})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(num, 64)
+}
+
+// parseAmount strips currency and separators from an amount and returns it as a plain decimal like "-1234.56"
+func parseAmount(s string, hint moneyHint) (string, string, error) {
+	num, currency := stripCurrency(s)
+	if currency == "" {
+		currency = strings.ToUpper(hint.Currency)
+	}
+
+	negative := false
+	num = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '\'' || r == '’' {
+			return -1
+		}
+		if r == '−' {
+			return '-'
+		}
+		return r
+	}, num)
+	if strings.HasPrefix(num, "(") && strings.HasSuffix(num, ")") {
+		negative = true
+		num = num[1 : len(num)-1]
+	}
+	if strings.HasPrefix(num, "-") {
+		negative = !negative
+		num = num[1:]
+	} else if strings.HasSuffix(num, "-") {
+		negative = !negative
+		num = num[:len(num)-1]
+	}
+	num = strings.TrimPrefix(num, "+")
+
+	if num == "" {
+		return "", currency, fmt.Errorf("no amount in '%s'", s)
+	}
+	for _, r := range num {
+		if !(r >= '0' && r <= '9') && r != '.' && r != ',' {
+			return "", currency, fmt.Errorf("invalid amount '%s'", s)
+		}
+	}
+
+	decimal := decimalSeparator(num, hint.Language, currency)
+	var b strings.Builder
+	if negative {
+		b.WriteRune('-')
+	}
+	digits := 0
+	for i, r := range num {
+		switch {
+		case r == decimal:
+			if i == len(num)-1 {
+				continue
+			}
+			b.WriteRune('.')
+		case r == '.' || r == ',':
+		default:
+			digits++
+			b.WriteRune(r)
+		}
+	}
+	if digits == 0 {
+		return "", currency, fmt.Errorf("invalid amount '%s'", s)
+	}
+
+	return b.String(), currency, nil
+}
+
+// stripCurrency removes currency symbols and ISO codes from an amount and returns the currency code found
+func stripCurrency(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	// longest symbols first so "us$" is not matched as "$"
+	for _, symbol := range []string{"us$", "fr.", "zł", "kč", "€", "£", "¥", "₩", "₹", "₽", "₺", "$"} {
+		if i := strings.Index(lower, symbol); i >= 0 {
+			return s[:i] + s[i+len(symbol):], currencySymbols[symbol]
+		}
+	}
+
+	fields := strings.Fields(s)
+	for i, field := range fields {
+		if len(field) == 3 && isUpperAlpha(field) {
+			return strings.Join(append(fields[:i:i], fields[i+1:]...), " "), field
+		}
+	}
+	// codes glued to the amount: "EUR12,50" or "12,50EUR"
+	if len(s) > 3 && isUpperAlpha(s[:3]) {
+		return s[3:], s[:3]
+	}
+	if len(s) > 3 && isUpperAlpha(s[len(s)-3:]) {
+		return s[:len(s)-3], s[len(s)-3:]
+	}
+	return s, ""
+}
+
+func isUpperAlpha(s string) bool {
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// decimalSeparator decides which separator, if any, marks the decimals of a number made of digits, points and commas.
+// Returns 0 if the number has no decimals.
+func decimalSeparator(num, language, currency string) rune {
+	lastPoint := strings.LastIndex(num, ".")
+	lastComma := strings.LastIndex(num, ",")
+	switch {
+	case lastPoint < 0 && lastComma < 0:
+		return 0
+	case lastPoint >= 0 && lastComma >= 0:
+		// both are present: the last one separates the decimals
+		if lastPoint > lastComma {
+			return '.'
+		}
+		return ','
+	}
+
+	sep, last := '.', lastPoint
+	if lastComma >= 0 {
+		sep, last = ',', lastComma
+	}
+	if strings.Count(num, string(sep)) > 1 {
+		return 0
+	}
+	if CurrencyDecimals(currency) == 0 {
+		return 0
+	}
+	if digits := len(num) - last - 1; digits != 3 {
+		return sep
+	}
+
+	// "1.234" or "1,234" is ambiguous. Money has 2 decimals unless the currency says otherwise
+	// but unit prices (e.g. fuel) are printed with 3, so trust the language if it is known.
+	if CurrencyDecimals(currency) == 3 {
+		return sep
+	}
+	if language != "" {
+		localeSep := '.'
+		if commaDecimalLanguages[strings.ToLower(language)] {
+			localeSep = ','
+		}
+		if sep == localeSep {
+			return sep
+		}
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Tax line field names. The field key of a single tax line field is built with TaxLineField.
+const (
+	TAX_RATE   = "rate"
+	TAX_BASE   = "base"
+	TAX_AMOUNT = "amount"
+)
+
+// TaxLine is the tax of a single tax rate as printed on the receipt
+type TaxLine struct {
+	// Rate in percent, e.g. 19 for 19% VAT
+	Rate float64 `json:"rate"`
+	// Base is the net amount the rate applies to. Zero if not printed.
+	Base   Money `json:"base"`
+	Amount Money `json:"amount"`
+}
+
+// Issue is a check the extracted values failed. The receipt should be reviewed by a human.
+type Issue struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// TaxLineField is the field key of a field of the i-th tax line, e.g. tax_lines.0.amount
+func TaxLineField(i int, name string) string {
+	return fmt.Sprintf("%s.%d.%s", FIELD_TAX_LINES, i, name)
+}
+
+// rateParser parses a tax rate like "19%", "7,7 %" or "0.19" into percent. Only rates without a percent sign
+// are taken as a fraction, "0,5 %" stays 0.5.
+func rateParser(s string, language string) (float64, error) {
+	s = strings.TrimSpace(s)
+	num := strings.TrimSpace(strings.TrimSuffix(s, "%"))
+	rate, err := quantityParser(num, language)
+	if err != nil {
+		return 0, err
+	}
+	if num != s {
+		return roundRate(rate), nil
+	}
+	return percent(rate), nil
+}
+
+// percent converts rates given as a fraction like 0.19 into percent
+func percent(rate float64) float64 {
+	if rate > 0 && rate < 1 {
+		rate *= 100
+	}
+	return roundRate(rate)
+}
+
+func roundRate(rate float64) float64 {
+	return math.Round(rate*10000) / 10000
+}
+
+// sumTaxLines sets the tax from the tax lines if the receipt does not print a total tax
+func (exp *Expense) sumTaxLines() {
+	if !exp.Tax.IsZero() || len(exp.TaxLines) == 0 {
+		return
+	}
+	tax := Money{Currency: exp.TaxLines[0].Amount.Currency}
+	for _, line := range exp.TaxLines {
+		tax.Amount += line.Amount.Amount
+	}
+	exp.Tax = tax
+}
+
+// checkTax records an issue for every amount that does not add up: subtotal + tax = total, the tax lines sum up to
+// the tax and each tax line amount is its base times the rate. Amounts may be off by the tolerance in major units of
+// the currency, if zero by one minor unit per tax line to allow for rounding on each line.
+func (exp *Expense) checkTax(tolerance float64) {
+	allowed := MoneyFromFloat(tolerance, exp.Currency).Amount
+	if allowed <= 0 {
+		allowed = int64(len(exp.TaxLines))
+	}
+	if allowed <= 0 {
+		allowed = 1
+	}
+
+	if !exp.Subtotal.IsZero() && !exp.Total.IsZero() {
+		// receipts with prices including tax may print the gross amount as subtotal
+		if !within(exp.Subtotal.Amount+exp.Tax.Amount, exp.Total.Amount, allowed) && !within(exp.Subtotal.Amount, exp.Total.Amount, allowed) {
+			exp.addIssue(FIELD_TOTAL, fmt.Sprintf("subtotal %s and tax %s do not add up to total %s", exp.Subtotal, exp.Tax, exp.Total))
+		}
+	}
+
+	if len(exp.TaxLines) > 0 && !exp.Tax.IsZero() {
+		sum := Money{Currency: exp.Tax.Currency}
+		for _, line := range exp.TaxLines {
+			sum.Amount += line.Amount.Amount
+		}
+		if !within(sum.Amount, exp.Tax.Amount, allowed) {
+			exp.addIssue(FIELD_TAX, fmt.Sprintf("tax lines add up to %s not tax %s", sum, exp.Tax))
+		}
+	}
+
+	for i, line := range exp.TaxLines {
+		if line.Base.IsZero() || line.Rate == 0 {
+			continue
+		}
+		want := line.Base.Convert(line.Rate/100, line.Amount.Currency)
+		if !within(want.Amount, line.Amount.Amount, allowed) {
+			exp.addIssue(TaxLineField(i, TAX_AMOUNT), fmt.Sprintf("%g%% of %s is %s not %s", line.Rate, line.Base, want, line.Amount))
+		}
+	}
+}
+
+// NeedsReview reports whether a human should check the expense: its amounts do not add up or the processors disagreed
+func (exp *Expense) NeedsReview() bool {
+	return len(exp.Issues) > 0 || len(exp.Review) > 0
+}
+
+func (exp *Expense) addIssue(field, message string) {
+	exp.Issues = append(exp.Issues, Issue{Field: field, Message: message})
+}
+
+func within(a, b, tolerance int64) bool {
+	diff := a - b
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= tolerance
+}
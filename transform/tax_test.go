@@ -0,0 +1,85 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateParser(t *testing.T) {
+	tcs := map[string]float64{
+		"19%":   19,
+		"7,7 %": 7.7,
+		"0.19":  19,
+		"5.5%":  5.5,
+		"0,5 %": 0.5,
+		"0,5%":  0.5,
+	}
+	for s, want := range tcs {
+		got, err := rateParser(s, "de")
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+
+	_, err := rateParser("MwSt", "de")
+	assert.Error(t, err)
+}
+
+func TestCheckTax(t *testing.T) {
+	eur := func(amount int64) Money { return Money{Amount: amount, Currency: "EUR"} }
+
+	type testCase struct {
+		name      string
+		exp       Expense
+		tolerance float64
+		issues    []string
+	}
+
+	tcs := []testCase{
+		{
+			name: "Adds up",
+			exp: Expense{
+				Currency: "EUR", Subtotal: eur(1000), Tax: eur(145), Total: eur(1145),
+				TaxLines: []TaxLine{{Rate: 19, Base: eur(500), Amount: eur(95)}, {Rate: 10, Base: eur(500), Amount: eur(50)}},
+			},
+		},
+		{
+			name: "Rounded per tax line",
+			exp: Expense{
+				Currency: "EUR", Subtotal: eur(1000), Tax: eur(146), Total: eur(1145),
+				TaxLines: []TaxLine{{Rate: 19, Base: eur(503), Amount: eur(96)}, {Rate: 10, Base: eur(497), Amount: eur(50)}},
+			},
+		},
+		{
+			name: "Gross subtotal",
+			exp:  Expense{Currency: "EUR", Subtotal: eur(1145), Tax: eur(145), Total: eur(1145)},
+		},
+		{
+			name:   "Total does not add up",
+			exp:    Expense{Currency: "EUR", Subtotal: eur(1000), Tax: eur(145), Total: eur(1245)},
+			issues: []string{FIELD_TOTAL},
+		},
+		{
+			name:      "Within tolerance",
+			exp:       Expense{Currency: "EUR", Subtotal: eur(1000), Tax: eur(145), Total: eur(1150)},
+			tolerance: 0.05,
+		},
+		{
+			name: "Tax lines do not add up",
+			exp: Expense{
+				Currency: "EUR", Subtotal: eur(1000), Tax: eur(145), Total: eur(1145),
+				TaxLines: []TaxLine{{Rate: 19, Base: eur(500), Amount: eur(95)}, {Rate: 10, Base: eur(500), Amount: eur(5)}},
+			},
+			issues: []string{FIELD_TAX, TaxLineField(1, TAX_AMOUNT)},
+		},
+	}
+
+	for _, tc := range tcs {
+		tc.exp.checkTax(tc.tolerance)
+		fields := make([]string, 0)
+		for _, issue := range tc.exp.Issues {
+			fields = append(fields, issue.Field)
+		}
+		assert.ElementsMatch(t, tc.issues, fields, tc.name)
+	}
+}
@@ -2,10 +2,11 @@ package transform
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"strconv"
+	"strings"
 	"time"
 
 	"github.com/likeawizard/document-ai-demo/config"
@@ -22,52 +23,70 @@ type DataTransform interface {
 }
 
 type DataTransformService struct {
-	FileStore store.FileStore
+	FileStore    store.FileStore
+	taxTolerance float64
 }
 
-func NewDataTransformService(cfg config.Config) (*DataTransformService, error) {
-	dts := DataTransformService{}
-	fs, err := store.NewFileStore(cfg.Store)
-	if err != nil {
-		return nil, err
-	}
-	dts.FileStore = fs
+func NewDataTransformService(cfg config.Config, fs store.FileStore) (*DataTransformService, error) {
+	dts := DataTransformService{FileStore: fs, taxTolerance: cfg.Transform.TaxTolerance}
 	return &dts, nil
 }
 
-func (dts *DataTransformService) Transform(receipt database.Receipt, schema string) error {
-	r, err := dts.FileStore.Get(receipt.GetJsonPath())
+// Transform parses the raw processor results of the receipt into the common Expense and stores it.
+// If more than one processor produced a result they are merged into one expense. Amounts that do not add up are listed in Issues.
+func (dts *DataTransformService) Transform(ctx context.Context, receipt database.Receipt) (*Expense, error) {
+	schemas := strings.Split(receipt.Processor, ",")
+
+	var expense *Expense
+	var err error
+	if len(schemas) == 1 {
+		expense, err = dts.toCommon(ctx, receipt.GetJsonPath(), schemas[0])
+	} else {
+		expenses := make([]*Expense, len(schemas))
+		for i, schema := range schemas {
+			expenses[i], err = dts.toCommon(ctx, receipt.GetRawPath(schema), schema)
+			if err != nil {
+				return nil, err
+			}
+		}
+		expense = Merge(expenses, schemas)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer r.Close()
+	expense.checkTax(dts.taxTolerance)
 
-	data, err := io.ReadAll(r)
+	data, err := json.Marshal(expense)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	dt, err := NewDataTransform(schema, data)
+	err = dts.FileStore.Store(ctx, receipt.GetExpensePath(), bytes.NewReader(data))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	expense, err := dt.ToCommon()
+	return expense, nil
+}
+
+func (dts *DataTransformService) toCommon(ctx context.Context, path, schema string) (*Expense, error) {
+	r, err := dts.FileStore.Get(ctx, path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer r.Close()
 
-	data, err = json.Marshal(expense)
+	data, err := io.ReadAll(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = dts.FileStore.Store(receipt.GetExpensePath(), bytes.NewReader(data))
+	dt, err := NewDataTransform(schema, data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return dt.ToCommon()
 }
 
 func NewDataTransform(schema string, data []byte) (DataTransform, error) {
@@ -84,9 +103,67 @@ func NewDataTransform(schema string, data []byte) (DataTransform, error) {
 type Expense struct {
 	Date     time.Time `json:"date"`
 	Currency string    `json:"currency"`
-	Total    float64   `json:"total"`
-	Tax      float64   `json:"tax"`
+	Total    Money     `json:"total"`
+	Tax      Money     `json:"tax"`
+	// Subtotal is the amount before tax as printed on the receipt
+	Subtotal Money `json:"subtotal"`
+	// TaxLines break down the tax per tax rate
+	TaxLines []TaxLine `json:"tax_lines,omitempty"`
 	Merchant Merchant  `json:"merchant"`
+	// PaymentType as printed on the receipt, e.g. "Visa", "Bar"
+	PaymentType string `json:"payment_type,omitempty"`
+	// Language is the ISO 639-1 code of the document language
+	Language string `json:"language,omitempty"`
+	// LineItems are the individual purchased items in the order they appear on the receipt
+	LineItems []LineItem `json:"line_items,omitempty"`
+	// Sources describes where each extracted field came from by field key
+	Sources map[string]Source `json:"sources,omitempty"`
+	// Review lists fields the processors disagreed on
+	Review []Disagreement `json:"review,omitempty"`
+	// Issues lists the amounts that do not add up, see checkTax
+	Issues []Issue `json:"issues,omitempty"`
+	// Conversions hold the money values converted into each target currency. Total, Tax and Currency keep the values printed on the receipt.
+	Conversions []Conversion `json:"conversions,omitempty"`
+	// Translation of the text fields. The fields themselves keep the text as printed on the receipt.
+	Translation *Translation `json:"translation,omitempty"`
+	// Category of the expense like meals or travel
+	Category string `json:"category,omitempty"`
+}
+
+// Translation of the expense text fields into Language by field key
+type Translation struct {
+	Language string            `json:"language"`
+	Fields   map[string]string `json:"fields"`
+}
+
+// Conversion of the expense money values into another currency with everything needed to audit it
+type Conversion struct {
+	Currency string  `json:"currency"`
+	Rate     float64 `json:"rate"`
+	// RateDate is the day of the exchange rate used
+	RateDate time.Time `json:"rate_date"`
+	Provider string    `json:"provider"`
+	Total    Money     `json:"total"`
+	Tax      Money     `json:"tax"`
+}
+
+// Source is the provenance of a single extracted field
+type Source struct {
+	// Confidence of the processor in the extracted value between 0 and 1
+	Confidence float64 `json:"confidence"`
+	// Content is the raw text the value was parsed from
+	Content   string `json:"content,omitempty"`
+	Processor string `json:"processor"`
+}
+
+type LineItem struct {
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity,omitempty"`
+	// UnitPrice is nil if the receipt does not print it
+	UnitPrice  *Price `json:"unit_price,omitempty"`
+	TotalPrice Money  `json:"total_price"`
+	// Confidence of the processor in the item as a whole
+	Confidence float64 `json:"confidence"`
 }
 
 type Merchant struct {
@@ -97,13 +174,37 @@ type Merchant struct {
 	MerchantPhone        string `json:"phone"`
 }
 
-// TODO: discover formatting. check 3rd to last symbol to determine decimal separator
-// remove everything else, replace discovered decimal with period and convert
-func moneyParser(s string) float64 {
-	f, err := strconv.ParseFloat(s, 64)
-	if err != nil {
-		return f
+func (exp *Expense) setSource(field string, source Source) {
+	if source.Confidence == 0 && source.Content == "" {
+		return
 	}
+	if exp.Sources == nil {
+		exp.Sources = make(map[string]Source)
+	}
+	exp.Sources[field] = source
+}
+
+// TextFields returns the non-empty free text fields that can be translated by field key
+func (exp *Expense) TextFields() map[string]string {
+	fields := map[string]string{
+		FIELD_MERCHANT_STRING:  exp.Merchant.StringVal,
+		FIELD_MERCHANT_NAME:    exp.Merchant.MerchantName,
+		FIELD_MERCHANT_ADDRESS: exp.Merchant.MerchantAddress,
+		FIELD_PAYMENT_TYPE:     exp.PaymentType,
+	}
+	for i, item := range exp.LineItems {
+		fields[ItemField(i, ITEM_DESCRIPTION)] = item.Description
+	}
+
+	for k, v := range fields {
+		if v == "" {
+			delete(fields, k)
+		}
+	}
+	return fields
+}
 
-	return f
+// Confidence of the processor in a field. Zero if the field was not extracted.
+func (exp *Expense) Confidence(field string) float64 {
+	return exp.Sources[field].Confidence
 }
@@ -1,6 +1,7 @@
 package transform
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -8,48 +9,229 @@ import (
 
 func TestMoneyParser(t *testing.T) {
 
-	delta := float64(0.005)
-
 	type testCase struct {
 		name      string
 		stringVal string
-		want      float64
+		hint      moneyHint
+		want      string
+		// rounded is the amount as Money if it differs from the exact unit price
+		rounded  string
+		currency string
+		wantErr  bool
 	}
 
 	tcs := []testCase{
 		{
 			name:      "Empty",
 			stringVal: "",
-			want:      0,
+			wantErr:   true,
 		},
 		{
 			name:      "Standard decimal",
 			stringVal: "12.34",
-			want:      12.34,
+			want:      "12.34",
 		},
 		{
 			name:      "Comma decimal",
 			stringVal: "12,34",
-			want:      12.34,
+			want:      "12.34",
 		},
 		{
 			name:      "Standard decimal, comma separator",
 			stringVal: "12,122.34",
-			want:      12122.34,
+			want:      "12122.34",
 		},
 		{
 			name:      "Comma decimal, point separator",
 			stringVal: "12.122,34",
-			want:      12122.34,
+			want:      "12122.34",
 		},
 		{
 			name:      "Non-numeric",
 			stringVal: "About Tree Fiddy and a quarter",
-			want:      0,
+			wantErr:   true,
+		},
+		{
+			name:      "Currency symbol",
+			stringVal: "12,50 €",
+			want:      "12.50",
+			currency:  "EUR",
+		},
+		{
+			name:      "ISO code",
+			stringVal: "USD 1,234.56",
+			want:      "1234.56",
+			currency:  "USD",
+		},
+		{
+			name:      "Space and apostrophe separators",
+			stringVal: "CHF 1'234.50",
+			want:      "1234.50",
+			currency:  "CHF",
+		},
+		{
+			name:      "Negative",
+			stringVal: "-5.00",
+			want:      "-5.00",
+		},
+		{
+			name:      "Trailing minus",
+			stringVal: "5,00-",
+			want:      "-5.00",
+		},
+		{
+			name:      "Parenthesised",
+			stringVal: "($5.00)",
+			want:      "-5.00",
+			currency:  "USD",
+		},
+		{
+			name:      "Zero-decimal currency",
+			stringVal: "¥1,500",
+			want:      "1500",
+			currency:  "JPY",
+		},
+		{
+			name:      "Zero-decimal currency hint",
+			stringVal: "1.500",
+			hint:      moneyHint{Currency: "JPY"},
+			want:      "1500",
+			currency:  "JPY",
+		},
+		{
+			name:      "Ambiguous thousands",
+			stringVal: "1,234",
+			want:      "1234.00",
+		},
+		{
+			name:      "Ambiguous decimals, language hint",
+			stringVal: "1,459",
+			hint:      moneyHint{Language: "de"},
+			want:      "1.459",
+			rounded:   "1.46",
+		},
+		{
+			name:      "Multiple thousands separators",
+			stringVal: "1.234.567",
+			want:      "1234567.00",
+		},
+		{
+			name:      "Surrounding text",
+			stringVal: "Total 12.34",
+			wantErr:   true,
 		},
 	}
 
 	for _, tc := range tcs {
-		assert.InDelta(t, moneyParser(tc.stringVal), tc.want, delta, tc.name)
+		got, err := moneyParser(tc.stringVal, tc.hint)
+		price, priceErr := priceParser(tc.stringVal, tc.hint)
+		if tc.wantErr {
+			assert.Error(t, err, tc.name)
+			assert.Error(t, priceErr, tc.name)
+			continue
+		}
+		assert.NoError(t, err, tc.name)
+		assert.NoError(t, priceErr, tc.name)
+		rounded := tc.want
+		if tc.rounded != "" {
+			rounded = tc.rounded
+		}
+		assert.Equal(t, rounded, got.String(), tc.name)
+		assert.Equal(t, tc.currency, got.Currency, tc.name)
+		assert.Equal(t, tc.want, price.String(), tc.name)
+		assert.Equal(t, tc.currency, price.Currency, tc.name)
 	}
 }
+
+func TestMoneyConvert(t *testing.T) {
+	type testCase struct {
+		name     string
+		amount   Money
+		rate     float64
+		currency string
+		want     string
+	}
+
+	tcs := []testCase{
+		{
+			name:     "Rounds half away from zero",
+			amount:   Money{Amount: 1001, Currency: "USD"},
+			rate:     0.5,
+			currency: "EUR",
+			want:     "5.01",
+		},
+		{
+			name:     "Negative",
+			amount:   Money{Amount: -1001, Currency: "USD"},
+			rate:     0.5,
+			currency: "EUR",
+			want:     "-5.01",
+		},
+		{
+			name:     "Into zero-decimal currency",
+			amount:   Money{Amount: 1250, Currency: "EUR"},
+			rate:     161.37,
+			currency: "JPY",
+			want:     "2017",
+		},
+		{
+			name:     "From zero-decimal currency",
+			amount:   Money{Amount: 1500, Currency: "JPY"},
+			rate:     0.0062,
+			currency: "EUR",
+			want:     "9.30",
+		},
+		{
+			name:     "No float drift",
+			amount:   Money{Amount: 10, Currency: "EUR"},
+			rate:     3,
+			currency: "EUR",
+			want:     "0.30",
+		},
+	}
+
+	for _, tc := range tcs {
+		got := tc.amount.Convert(tc.rate, tc.currency)
+		assert.Equal(t, tc.want, got.String(), tc.name)
+		assert.Equal(t, tc.currency, got.Currency, tc.name)
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	m := Money{Amount: 123456, Currency: "EUR"}
+	data, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"amount": "1234.56", "currency": "EUR"}`, string(data))
+
+	var got Money
+	err = json.Unmarshal(data, &got)
+	assert.NoError(t, err)
+	assert.Equal(t, m, got, "Round trip is lossless")
+
+	err = json.Unmarshal([]byte(`12.5`), &got)
+	assert.NoError(t, err, "Plain numbers of older expenses are accepted")
+	assert.Equal(t, Money{Amount: 1250}, got)
+
+	err = json.Unmarshal([]byte(`{"amount": "abc"}`), &got)
+	assert.Error(t, err)
+}
+
+func TestPriceJSON(t *testing.T) {
+	p := Price{Amount: 1459, Scale: 3, Currency: "EUR"}
+	data, err := json.Marshal(p)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"amount": "1.459", "currency": "EUR"}`, string(data))
+
+	var got Price
+	err = json.Unmarshal(data, &got)
+	assert.NoError(t, err)
+	assert.Equal(t, p, got, "Round trip is lossless")
+
+	err = json.Unmarshal([]byte(`{"amount": "4.9", "currency": "EUR"}`), &got)
+	assert.NoError(t, err)
+	assert.Equal(t, "4.90", got.String(), "At least the decimals of the currency")
+
+	err = json.Unmarshal([]byte(`1.5`), &got)
+	assert.NoError(t, err, "Plain numbers of older expenses are accepted")
+	assert.Equal(t, "1.50", got.String())
+}
@@ -1,9 +1,13 @@
 package web
 
 import (
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -18,30 +22,35 @@ var Router *gin.Engine
 type RestService struct {
 	Router    *gin.Engine
 	Db        database.DB
-	EventChan expense.EventChan
+	Pipeline  expense.Submitter
 	FileStore store.FileStore
+	// RetryAfter is sent to clients when the pipeline has no room for new receipts
+	RetryAfter time.Duration
+	// signer checks the download URLs handed out by stores without URLs of their own
+	signer *store.URLSigner
 }
 
+const defaultRetryAfter = 30 * time.Second
+
+// tenantHeader names the tenant an upload belongs to. It is not authenticated and only advisory: it picks the default
+// target currencies of the tenant and must not be used to restrict access.
+const tenantHeader = "X-Tenant"
+
 // Define allowed file types. source: https://cloud.google.com/document-ai/docs/file-types
 var supportedMimeTypes = []string{"application/pdf", "image/gif", "image/tiff", "image/jpeg", "image/png", "image/bmp", "image/webp"}
 
-func NewRestService(cfg config.Config, eventChan expense.EventChan) (*RestService, error) {
+func NewRestService(cfg config.Config, db database.DB, fs store.FileStore, pipeline expense.Submitter) (*RestService, error) {
 	rest := RestService{
-		Router:    NewRouter(cfg.App),
-		EventChan: eventChan,
+		Router:     NewRouter(cfg.App),
+		Db:         db,
+		Pipeline:   pipeline,
+		FileStore:  fs,
+		RetryAfter: cfg.Queue.RetryAfter,
+		signer:     store.NewURLSigner(cfg.Store),
 	}
-
-	db, err := database.NewDataBase(cfg.Db)
-	if err != nil {
-		return nil, err
+	if rest.RetryAfter <= 0 {
+		rest.RetryAfter = defaultRetryAfter
 	}
-	rest.Db = db
-
-	store, err := store.NewFileStore(cfg.Store)
-	if err != nil {
-		return nil, err
-	}
-	rest.FileStore = store
 	rest.registerRoutes()
 
 	return &rest, nil
@@ -52,7 +61,9 @@ func (rest *RestService) registerRoutes() {
 	expenses := rest.Router.Group("expenses")
 	expenses.POST("", rest.expensesCreate)
 	expenses.GET(":uuid", rest.expensesGetOne)
-	expenses.GET("", rest.expensesGetByTags)
+	expenses.GET(":uuid/expense", rest.expensesGetExpense)
+	expenses.GET("", rest.expensesQuery)
+	rest.Router.GET(store.FILES_PATH+":name", rest.filesGet)
 }
 
 func NewRouter(cfg config.AppCfg) *gin.Engine {
@@ -66,10 +77,21 @@ func NewRouter(cfg config.AppCfg) *gin.Engine {
 }
 
 func (rest *RestService) expensesCreate(c *gin.Context) {
+	err := rest.Pipeline.Accepting()
+	if err != nil {
+		rest.abortBusy(c, err)
+		return
+	}
+
 	id := uuid.New()
-	formFile, _ := c.FormFile("file")
 	params := c.Request.URL.Query()
 	tags := params["tags"]
+	currencies, err := config.ParseCurrencies(params["currency"])
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	formFile, _ := c.FormFile("file")
 	mimeType := formFile.Header.Get("Content-Type")
 	if !isSupportedMimeType(mimeType) {
 		c.AbortWithError(http.StatusBadRequest, fmt.Errorf("unsupported MIME Type '%s'", mimeType))
@@ -83,16 +105,35 @@ func (rest *RestService) expensesCreate(c *gin.Context) {
 	defer f.Close()
 
 	newFilename := fmt.Sprintf("%s%s", id, filepath.Ext(formFile.Filename))
-	rest.FileStore.Store(newFilename, f)
+	err = rest.FileStore.Store(c.Request.Context(), newFilename, f)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 
 	receipt := database.New(id)
 	receipt.Filename = formFile.Filename
 	receipt.MimeType = mimeType
 	receipt.Path = newFilename
 	receipt.Tags = tags
-	rest.Db.Create(receipt)
+	receipt.Tenant = c.GetHeader(tenantHeader)
+	receipt.Currencies = currencies
+	err = rest.Db.Create(receipt)
+	if err != nil {
+		rest.FileStore.Delete(c.Request.Context(), newFilename)
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
 
-	rest.EventChan.MsgNew(receipt)
+	err = rest.Pipeline.Submit(receipt)
+	if err != nil {
+		// the receipt never reaches the pipeline, keep it from being recovered on the next start
+		receipt.Status = database.S_FAILED
+		rest.Db.Update(receipt)
+		rest.FileStore.Delete(c.Request.Context(), newFilename)
+		rest.abortBusy(c, err)
+		return
+	}
 
 	c.IndentedJSON(http.StatusOK, receipt)
 }
@@ -114,22 +155,117 @@ func (rest *RestService) expensesGetOne(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, receipt)
 }
 
-func (rest *RestService) expensesGetByTags(c *gin.Context) {
+// expensesGetExpense returns the extracted expense of a receipt once it was transformed
+func (rest *RestService) expensesGetExpense(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("uuid"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	receipt, err := rest.Db.Get(id)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+
+	f, err := rest.FileStore.Get(c.Request.Context(), receipt.GetExpensePath())
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, fmt.Errorf("no expense for receipt %s yet", id))
+		return
+	}
+	defer f.Close()
+
+	c.DataFromReader(http.StatusOK, -1, "application/json", f, nil)
+}
+
+// expensesQuery returns the receipts with any of the tags, in the category or both
+func (rest *RestService) expensesQuery(c *gin.Context) {
 	params := c.Request.URL.Query()
-	tags, ok := params["tags"]
-	if !ok || len(tags) < 1 {
+	tags := params["tags"]
+	category := params.Get("category")
+	review := params.Get("review") == "true"
+
+	var receipts []database.Receipt
+	var err error
+	switch {
+	case len(tags) > 0:
+		receipts, err = rest.Db.GetByTags(tags)
+		if category != "" {
+			receipts = inCategory(receipts, category)
+		}
+	case category != "":
+		receipts, err = rest.Db.GetByCategory(category)
+	case review:
+		receipts, err = rest.Db.GetNeedsReview()
+	default:
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	receipts, err := rest.Db.GetByTags(tags)
 	if err != nil {
 		c.AbortWithError(http.StatusNotFound, err)
 		return
 	}
+	if review {
+		receipts = needingReview(receipts)
+	}
 
 	c.IndentedJSON(http.StatusOK, receipts)
 }
 
+func inCategory(receipts []database.Receipt, category string) []database.Receipt {
+	filtered := make([]database.Receipt, 0, len(receipts))
+	for _, receipt := range receipts {
+		if receipt.Category == category {
+			filtered = append(filtered, receipt)
+		}
+	}
+	return filtered
+}
+
+func needingReview(receipts []database.Receipt) []database.Receipt {
+	filtered := make([]database.Receipt, 0, len(receipts))
+	for _, receipt := range receipts {
+		if receipt.NeedsReview {
+			filtered = append(filtered, receipt)
+		}
+	}
+	return filtered
+}
+
+// filesGet serves a stored file to whoever holds a valid signed URL for it, e.g. a processor downloading the receipt
+func (rest *RestService) filesGet(c *gin.Context) {
+	name := c.Param("name")
+	err := rest.signer.Verify(name, c.Request.URL.Query())
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return
+	}
+
+	f, err := rest.FileStore.Get(c.Request.Context(), name)
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, err)
+		return
+	}
+	defer f.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.DataFromReader(http.StatusOK, -1, contentType, f, nil)
+}
+
+// abortBusy rejects an upload the pipeline has no room for and tells the client when to try again
+func (rest *RestService) abortBusy(c *gin.Context, err error) {
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, expense.ErrQueueFull) {
+		status = http.StatusTooManyRequests
+	}
+	c.Header("Retry-After", strconv.Itoa(int(rest.RetryAfter.Seconds())))
+	c.AbortWithError(status, err)
+}
+
 func isSupportedMimeType(mimeType string) bool {
 	for _, supported := range supportedMimeTypes {
 		if supported == mimeType {